@@ -5,6 +5,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -126,9 +130,21 @@ type QStat struct {
 	Today       int64
 	ErrToday    int64
 	AvgMS       float32
+	P50MS       float32
+	P90MS       float32
+	P99MS       float32
+	MaxMS       int64
 	LogsEnabled bool
 	Active      bool
 	UpdatedOn   time.Time
+
+	// RejectWhilePaused makes enq refuse new tasks while the queue is
+	// not Active.  When false, tasks are accepted and held until resumed.
+	RejectWhilePaused bool
+
+	// LogCount is the number of stored logs, counted by the purge job
+	LogCount      int64
+	LogsCountedOn time.Time
 }
 
 // QStatKind is the name of the datastore table for queue stats
@@ -142,6 +158,13 @@ type AdminPage struct {
 	NumErrToday int64
 	Qs          []*QStat
 	URLs        []*QStat
+	NumDrift    int
+
+	// Timezone is the timezone for today's stats
+	Timezone string
+
+	// Backlog is from taskqueue.QueueStats, or nil if it failed
+	Backlog []QueueBacklog
 }
 
 // admin renders the administrative interface for the server
@@ -158,40 +181,57 @@ func admin(w http.ResponseWriter, r *http.Request) {
 
 	p.Title = "Loop PushQ Admin Console"
 	now := time.Now().UTC()
-	nowf := getTodayf(now)
 
-	log.Debugf(ctx, "admin nowf: %s", nowf)
+	// Today is in the reporting timezone unless tz picks another
+	loc, err := loadTimezone(r.URL.Query().Get("tz"))
+	if err != nil {
+		pageFail(w, "Invalid tz: "+err.Error())
+		return
+	}
+	p.Timezone = loc.String()
 
 	// Overall Stats
 	var c int64
-	var err error
-	if c, err = Count(ctx, EnqCt); err != nil {
+	if c, err = Count(ctx, newCounterKey(EnqCt, "", "", PeriodAll,
+		now)); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	p.NumEnq = c
 
-	if c, err = Count(ctx, EnqCt+nowf); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	p.NumEnqToday = c
-
-	if c, err = Count(ctx, ErrCt+nowf); err != nil {
+	today, err := getTodayStats(ctx, "", "", loc, now)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	p.NumErrToday = c
+	p.NumEnqToday = today.Counts[EnqCt]
+	p.NumErrToday = today.Counts[ErrCt]
 
 	// Queue Stats
-	qNames := *QNames
-	for qn := range qNames {
+	for _, def := range QueueDefs {
 		s := QStat{}
-		s.Name = qn
-		getStats(ctx, &s, s.Name, nowf)
+		s.Name = def.Name
+		getStats(ctx, &s, def.Name, "", now, loc)
 		p.Qs = append(p.Qs, &s)
 	}
 
+	// The dashboard still shows counters if the backlog can't be read
+	if p.Backlog, err = getQueueBacklogs(ctx, queueNames()); err != nil {
+		log.Errorf(ctx, "Unable to get queue stats: %s", err.Error())
+	}
+
+	// Flag differences between queue.yaml and the registry
+	registry, err := getRegistry(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, qc := range registry {
+		if len(qc.Drift) > 0 {
+			p.NumDrift++
+		}
+	}
+
 	q := datastore.NewQuery(AllURLsKind)
 	var urls []AllURLs
 	if _, err := q.GetAll(ctx, &urls); err != nil {
@@ -201,7 +241,7 @@ func admin(w http.ResponseWriter, r *http.Request) {
 	for _, url := range urls {
 		s := QStat{}
 		s.Name = url.URL
-		if err = getStats(ctx, &s, s.Name, nowf); err != nil {
+		if err = getStats(ctx, &s, "", url.URL, now, loc); err != nil {
 			pageFail(w, err.Error())
 			return
 		}
@@ -232,38 +272,40 @@ func getOrCreateQStat(ctx context.Context, s *QStat, name string) error {
 	return nil
 }
 
-func getStats(ctx context.Context, s *QStat, name string, nowf string) error {
+// getStats loads the stats for a queue or a URL.  One of queue and url
+// is blank.  Today is the day that holds now in loc.
+func getStats(ctx context.Context, s *QStat, queue, url string,
+	now time.Time, loc *time.Location) error {
 
 	var c int64
 	var err error
 
 	// First look for the latest stored copy of stats, which also
 	// has config entries.
-	if err = getOrCreateQStat(ctx, s, name); err != nil {
+	if err = getOrCreateQStat(ctx, s, queue+url); err != nil {
 		return err
 	}
 
-	if c, err = Count(ctx, EnqCt+name); err == nil {
+	if c, err = Count(ctx, newCounterKey(EnqCt, queue, url, PeriodAll,
+		now)); err == nil {
 		s.Total = c
 	}
-	if c, err = Count(ctx, EnqCt+name+nowf); err == nil {
-		s.Today = c
-	}
-	if c, err = Count(ctx, ErrCt+name+nowf); err == nil {
-		s.ErrToday = c
-	}
-	if c, err = Count(ctx, AvgTotalCt+name+nowf); err == nil {
-		if accum, err := Count(ctx, AvgAccumCt+s.Name+nowf); err == nil {
-			if c > 0 {
-				s.AvgMS = float32(accum) / float32(c)
-			}
+	if today, err := getTodayStats(ctx, queue, url, loc, now); err == nil {
+		s.Today = today.Counts[EnqCt]
+		s.ErrToday = today.Counts[ErrCt]
+		if total := today.Counts[AvgTotalCt]; total > 0 {
+			s.AvgMS = float32(today.Counts[AvgAccumCt]) / float32(total)
 		}
+		s.P50MS = float32(today.Latency.P50MS)
+		s.P90MS = float32(today.Latency.P90MS)
+		s.P99MS = float32(today.Latency.P99MS)
+		s.MaxMS = today.Latency.MaxMS
 	}
 
 	s.UpdatedOn = time.Now().UTC()
 
 	// Now re-save the latest stats, retaining config entries
-	key := datastore.NewKey(ctx, QStatKind, name, 0, nil)
+	key := datastore.NewKey(ctx, QStatKind, queue+url, 0, nil)
 	if _, err := datastore.Put(ctx, key, s); err != nil {
 		return err
 	}
@@ -352,6 +394,59 @@ func delAPIKey(w http.ResponseWriter, r *http.Request) {
 	okJSON(w, ak)
 }
 
+// setKeyQueues is called from JS on the keys page.  It sets the queues
+// whose logs an API Key can read, and the key's scopes.
+func setKeyQueues(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	log.Debugf(ctx, "setKeyQueues called")
+
+	var p Page
+	if !initPage(ctx, w, r, &p) {
+		return
+	}
+
+	// Decode the POST body
+	decoder := json.NewDecoder(r.Body)
+	var ak APIKey
+	err := decoder.Decode(&ak)
+	if err != nil {
+		failJSON(w, err.Error())
+		return
+	}
+
+	for _, q := range ak.Queues {
+		if _, ok := getQueueDef(q); !ok {
+			failJSON(w, "Invalid QueueName: "+q)
+			return
+		}
+	}
+	for _, scope := range ak.Scopes {
+		if scope != ScopeMetrics {
+			failJSON(w, "Invalid scope: "+scope)
+			return
+		}
+	}
+
+	// Get the stored key, which has the secret hash
+	var stored APIKey
+	k := datastore.NewKey(ctx, APIKeyKind, ak.Key, 0, nil)
+	if err := datastore.Get(ctx, k, &stored); err != nil &&
+		!isErrFieldMismatch(err) {
+		failJSON(w, err.Error())
+		return
+	}
+
+	stored.Queues = ak.Queues
+	stored.Scopes = ak.Scopes
+	if _, err := datastore.Put(ctx, k, &stored); err != nil {
+		failJSON(w, err.Error())
+		return
+	}
+
+	okJSON(w, ak.Key)
+}
+
 // toggleQueueLogs changes the log setting for a single queue
 func toggleQueueLogs(w http.ResponseWriter, r *http.Request) {
 	var err error
@@ -398,11 +493,65 @@ func toggleQueueLogs(w http.ResponseWriter, r *http.Request) {
 	okJSON(w, "Ok")
 }
 
+// toggleQueueActive pauses or resumes a single queue.  While a queue is
+// paused, callback holds deliveries instead of calling the URL.
+func toggleQueueActive(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	ctx := appengine.NewContext(r)
+
+	log.Debugf(ctx, "toggleQueueActive called")
+
+	var p Page
+	if !initPage(ctx, w, r, &p) {
+		return
+	}
+
+	// Decode the POST body
+	decoder := json.NewDecoder(r.Body)
+	var s QStat
+	err = decoder.Decode(&s)
+	if err != nil {
+		failJSON(w, err.Error())
+		return
+	}
+
+	// Get the currently stored config
+	var stored QStat
+	key := datastore.NewKey(ctx, QStatKind, s.Name, 0, nil)
+	err = datastore.Get(ctx, key, &stored)
+	if err != nil {
+		if isErrFieldMismatch(err) {
+			// Ignore
+		} else {
+			// It should be there
+			failJSON(w, err.Error())
+			return
+		}
+	}
+
+	stored.Active = s.Active
+	stored.RejectWhilePaused = s.RejectWhilePaused
+	_, err = datastore.Put(ctx, key, &stored)
+	if err != nil {
+		failJSON(w, err.Error())
+		return
+	}
+
+	okJSON(w, stored)
+}
+
 // LogPage is a view model for the page displaying queue logs
 type LogPage struct {
 	Page
 	QueueName string
-	Logs      []TaskLog
+	Logs      []LogEntry
+	Filter    LogFilter
+	LogTypes  []string
+	URLs      []string
+	FromF     string
+	ToF       string
+	NextURL   string
 }
 
 func logs(w http.ResponseWriter, r *http.Request) {
@@ -421,12 +570,785 @@ func logs(w http.ResponseWriter, r *http.Request) {
 
 	p.Title = fmt.Sprintf("Loop PushQ Admin Console - %s Logs", p.QueueName)
 
-	// TODO
-	q := datastore.NewQuery(TaskLogKind).Limit(100)
-	if _, err := q.GetAll(ctx, &p.Logs); err != nil {
+	var fields []FieldError
+	if p.Filter, fields = parseLogFilter(r); len(fields) > 0 {
+		pageFail(w, fields[0].Message)
+		return
+	}
+	p.Filter.QueueName = p.QueueName
+	if !p.Filter.From.IsZero() {
+		p.FromF = p.Filter.From.Format(LogTimeFormat)
+	}
+	if !p.Filter.To.IsZero() {
+		p.ToF = p.Filter.To.Format(LogTimeFormat)
+	}
+
+	// Options for the filter dropdowns
+	p.LogTypes = LogTypes
+	q := datastore.NewQuery(AllURLsKind)
+	var urls []AllURLs
+	if _, err := q.GetAll(ctx, &urls); err != nil {
+		pageFail(w, err.Error())
+		return
+	}
+	for _, u := range urls {
+		p.URLs = append(p.URLs, u.URL)
+	}
+
+	logs, keys, next, err := queryLogs(ctx, &p.Filter)
+	if err != nil {
 		pageFail(w, err.Error())
 		return
 	}
+	for i, tl := range logs {
+		p.Logs = append(p.Logs, LogEntry{
+			ID:          keys[i].IntID(),
+			TaskLog:     tl,
+			IsEncrypted: len(tl.Encrypted) > 0,
+		})
+	}
+	if next != "" {
+		v := p.Filter.Values()
+		v.Set("cursor", next)
+		p.NextURL = "/admin/logs/" + url.PathEscape(p.QueueName) + "?" +
+			v.Encode()
+	}
+
+	// Only some admins can see decrypted payloads and headers
+	if canDecrypt(ctx) {
+		kr, err := getKeyring()
+		if err != nil {
+			pageFail(w, err.Error())
+			return
+		}
+		for i := range p.Logs {
+			if err := unsealLog(kr, &p.Logs[i].TaskLog); err != nil {
+				log.Errorf(ctx, "Unable to decrypt log: %s", err.Error())
+			}
+		}
+	}
 
 	renderPage(w, r, p, "logs.html")
 }
+
+// LogDetailPage is a view model for the page displaying a single log entry
+type LogDetailPage struct {
+	Page
+	Log      LogEntry
+	Payload  string
+	Curl     string
+	Attempts []LogEntry
+}
+
+// logDetail renders a single log entry, with the other log entries for
+// the same task
+func logDetail(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	log.Debugf(ctx, "logDetail called")
+
+	p := LogDetailPage{}
+
+	if !initPage(ctx, w, r, &p.Page) {
+		return
+	}
+
+	params := mux.Vars(r)
+	id, err := strconv.ParseInt(params["id"], 10, 64)
+	if err != nil {
+		pageFail(w, "Invalid log id")
+		return
+	}
+
+	key := datastore.NewKey(ctx, TaskLogKind, "", id, nil)
+	p.Log.ID = id
+	if err := datastore.Get(ctx, key, &p.Log.TaskLog); err != nil &&
+		!isErrFieldMismatch(err) {
+		pageFail(w, err.Error())
+		return
+	}
+	p.Log.IsEncrypted = len(p.Log.Encrypted) > 0
+
+	// Only some admins can see decrypted payloads and headers
+	if p.Log.IsEncrypted && canDecrypt(ctx) {
+		kr, err := getKeyring()
+		if err == nil {
+			err = unsealLog(kr, &p.Log.TaskLog)
+		}
+		if err != nil {
+			pageFail(w, err.Error())
+			return
+		}
+	}
+
+	p.Payload = prettyJSON(p.Log.Payload)
+	if len(p.Log.Encrypted) == 0 {
+		p.Curl = curlCommand(&p.Log.Task)
+	}
+
+	// All logs for the same task, by attempt
+	if p.Log.TaskName != "" {
+		q := datastore.NewQuery(TaskLogKind).
+			Filter("tn =", p.Log.TaskName).
+			Order("att").Order("utc").Limit(100)
+		var attempts []TaskLog
+		keys, err := q.GetAll(ctx, &attempts)
+		if err != nil && !isErrFieldMismatch(err) {
+			pageFail(w, err.Error())
+			return
+		}
+		for i, tl := range attempts {
+			p.Attempts = append(p.Attempts, LogEntry{
+				ID:          keys[i].IntID(),
+				TaskLog:     tl,
+				IsEncrypted: len(tl.Encrypted) > 0,
+			})
+		}
+	}
+
+	p.Title = fmt.Sprintf("Loop PushQ Admin Console - Log %d", id)
+
+	renderPage(w, r, p, "logdetail.html")
+}
+
+// prettyJSON indents s if it is JSON, or returns it as is
+func prettyJSON(s string) string {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, []byte(s), "", "    "); err != nil {
+		return s
+	}
+	return buf.String()
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// curlCommand builds a curl command that repeats the request callback
+// makes for a task.  Secret placeholders and redacted values are left as
+// they are in the log.
+func curlCommand(task *Task) string {
+	t := *task
+	t.Sealed = nil
+	body, err := json.Marshal(t)
+	if err != nil {
+		return ""
+	}
+
+	cmd := "curl -X POST " + shellQuote(task.URL) +
+		" \\\n  -H " + shellQuote("Content-Type: application/json")
+	for _, h := range task.Headers {
+		cmd += " \\\n  -H " + shellQuote(h.Name+": "+h.Value)
+	}
+	cmd += " \\\n  --data-binary " + shellQuote(string(body))
+	return cmd
+}
+
+// QueuesPage is a view model for the queue registry page
+type QueuesPage struct {
+	Page
+	Queues []QueueConfig
+}
+
+// queues renders the queue registry admin page
+func queues(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	log.Debugf(ctx, "queues called")
+
+	p := QueuesPage{}
+
+	if !initPage(ctx, w, r, &p.Page) {
+		return
+	}
+
+	var err error
+	if p.Queues, err = getRegistry(ctx); err != nil {
+		pageFail(w, err.Error())
+		return
+	}
+
+	p.Title = "Loop PushQ Admin Console - Queues"
+
+	renderPage(w, r, p, "queues.html")
+}
+
+// QueuePage is a view model for a single queue's config page
+type QueuePage struct {
+	Page
+	Queue QueueConfig
+
+	// Backlog is from taskqueue.QueueStats, or nil for queues that
+	// aren't in queue.yaml
+	Backlog *QueueBacklog
+
+	// Audit has the newest purges of the queue
+	Audit []AuditEntry
+}
+
+// queue renders the config page for a single queue
+func queue(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	log.Debugf(ctx, "queue called")
+
+	p := QueuePage{}
+
+	if !initPage(ctx, w, r, &p.Page) {
+		return
+	}
+
+	params := mux.Vars(r)
+	name := params["name"]
+
+	// Queues that are registered but not in queue.yaml can still be edited
+	if err := getOrCreateQueueConfig(ctx, &p.Queue, name); err != nil {
+		pageFail(w, err.Error())
+		return
+	}
+
+	if _, ok := getQueueDef(name); ok {
+		backlogs, err := getQueueBacklogs(ctx, []string{name})
+		if err != nil {
+			log.Errorf(ctx, "Unable to get queue stats: %s", err.Error())
+		} else {
+			p.Backlog = &backlogs[0]
+		}
+	}
+
+	audit, err := getAuditEntries(ctx, name, 10)
+	if err != nil {
+		log.Errorf(ctx, "Unable to get audit entries: %s", err.Error())
+	}
+	p.Audit = audit
+
+	p.Title = fmt.Sprintf("Loop PushQ Admin Console - %s Queue", name)
+
+	renderPage(w, r, p, "queue.html")
+}
+
+// queueRegistry emits the queue registry, with drift, as JSON
+func queueRegistry(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	log.Debugf(ctx, "queueRegistry called")
+
+	var p Page
+	if !initPage(ctx, w, r, &p) {
+		return
+	}
+
+	registry, err := getRegistry(ctx)
+	if err != nil {
+		failJSON(w, err.Error())
+		return
+	}
+
+	okJSON(w, registry)
+}
+
+// saveQueueConfig creates or updates a registry entry.  Queues can be
+// registered before they are added to queue.yaml, but enq won't accept
+// tasks for them until they are deployed.
+func saveQueueConfig(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	ctx := appengine.NewContext(r)
+
+	log.Debugf(ctx, "saveQueueConfig called")
+
+	var p Page
+	if !initPage(ctx, w, r, &p) {
+		return
+	}
+
+	// Decode the POST body
+	decoder := json.NewDecoder(r.Body)
+	var qc QueueConfig
+	err = decoder.Decode(&qc)
+	if err != nil {
+		failJSON(w, err.Error())
+		return
+	}
+	if qc.Name == "" {
+		failJSON(w, "Name is required")
+		return
+	}
+
+	// Get the currently stored config, if any
+	var stored QueueConfig
+	key := datastore.NewKey(ctx, QueueConfigKind, qc.Name, 0, nil)
+	err = datastore.Get(ctx, key, &stored)
+	if err == datastore.ErrNoSuchEntity {
+		if def, ok := getQueueDef(qc.Name); ok {
+			stored = newQueueConfig(def)
+		}
+		stored.Name = qc.Name
+	} else if err != nil && !isErrFieldMismatch(err) {
+		failJSON(w, err.Error())
+		return
+	}
+
+	stored.Description = qc.Description
+	stored.DefaultTimeoutSeconds = qc.DefaultTimeoutSeconds
+	stored.DefaultHeaders = qc.DefaultHeaders
+	stored.DefaultRetry = qc.DefaultRetry
+	stored.MaxTimeoutSeconds = qc.MaxTimeoutSeconds
+	stored.MaxPayloadBytes = qc.MaxPayloadBytes
+	stored.AllowedURLPrefixes = qc.AllowedURLPrefixes
+	stored.Redact = qc.Redact
+	stored.LogRetentionDays = qc.LogRetentionDays
+	if err = validatePolicy(&stored); err != nil {
+		failJSON(w, err.Error())
+		return
+	}
+	stored.UpdatedOn = time.Now().UTC()
+	_, err = datastore.Put(ctx, key, &stored)
+	if err != nil {
+		failJSON(w, err.Error())
+		return
+	}
+
+	stored.Drift = queueDrift(&stored)
+	okJSON(w, stored)
+}
+
+// delQueueConfig deletes a registry entry.  A queue that is still in
+// queue.yaml is registered again with default config the next time it's used.
+func delQueueConfig(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	log.Debugf(ctx, "delQueueConfig called")
+
+	var p Page
+	if !initPage(ctx, w, r, &p) {
+		return
+	}
+
+	// Decode the POST body
+	decoder := json.NewDecoder(r.Body)
+	var qc QueueConfig
+	err := decoder.Decode(&qc)
+	if err != nil {
+		failJSON(w, err.Error())
+		return
+	}
+
+	key := datastore.NewKey(ctx, QueueConfigKind, qc.Name, 0, nil)
+	if err := datastore.Delete(ctx, key); err != nil {
+		failJSON(w, err.Error())
+		return
+	}
+
+	okJSON(w, qc)
+}
+
+// syncQueues registers every queue in queue.yaml and clears drift
+func syncQueues(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	log.Debugf(ctx, "syncQueues called")
+
+	var p Page
+	if !initPage(ctx, w, r, &p) {
+		return
+	}
+
+	if err := syncRegistry(ctx); err != nil {
+		failJSON(w, err.Error())
+		return
+	}
+
+	okJSON(w, "Ok")
+}
+
+// SecretsPage is a view model for the secrets page.  Values are never shown.
+type SecretsPage struct {
+	Page
+	Secrets []Secret
+}
+
+// secrets renders the secrets admin page
+func secrets(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	log.Debugf(ctx, "secrets called")
+
+	p := SecretsPage{}
+
+	if !initPage(ctx, w, r, &p.Page) {
+		return
+	}
+
+	q := datastore.NewQuery(SecretKind).Order("Name")
+	if _, err := q.GetAll(ctx, &p.Secrets); err != nil &&
+		!isErrFieldMismatch(err) {
+		pageFail(w, err.Error())
+		return
+	}
+
+	p.Title = "Loop PushQ Admin Console - Secrets"
+
+	renderPage(w, r, p, "secrets.html")
+}
+
+// setSecret is called from JS on the secrets page.  It creates or
+// replaces a secret.
+func setSecret(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	log.Debugf(ctx, "setSecret called")
+
+	var p Page
+	if !initPage(ctx, w, r, &p) {
+		return
+	}
+
+	// Decode the POST body
+	decoder := json.NewDecoder(r.Body)
+	var s Secret
+	err := decoder.Decode(&s)
+	if err != nil {
+		failJSON(w, err.Error())
+		return
+	}
+
+	s.UpdatedBy = p.Name
+	if err := saveSecret(ctx, &s); err != nil {
+		failJSON(w, err.Error())
+		return
+	}
+
+	okJSON(w, s.Name)
+}
+
+// delSecret is called from JS on the secrets page.  It deletes a secret.
+func delSecret(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	log.Debugf(ctx, "delSecret called")
+
+	var p Page
+	if !initPage(ctx, w, r, &p) {
+		return
+	}
+
+	// Decode the POST body
+	decoder := json.NewDecoder(r.Body)
+	var s Secret
+	err := decoder.Decode(&s)
+	if err != nil {
+		failJSON(w, err.Error())
+		return
+	}
+
+	k := datastore.NewKey(ctx, SecretKind, s.Name, 0, nil)
+	if err := datastore.Delete(ctx, k); err != nil {
+		failJSON(w, err.Error())
+		return
+	}
+
+	okJSON(w, s.Name)
+}
+
+// CounterRow is a counter on the counters page
+type CounterRow struct {
+	CounterKey
+	Name   string
+	Shards int
+	Total  int64
+}
+
+// CountersPage is a view model for the counters page
+type CountersPage struct {
+	Page
+	Counters  []CounterRow
+	MaxShards int
+
+	// The counter looked up with the form, in its current bucket
+	Metric string
+	Queue  string
+	URL    string
+	Period string
+	Lookup *CounterRow
+}
+
+// countersPageLimit is the number of counters listed on the counters page
+const countersPageLimit int = 100
+
+// counters renders the counters admin page, which lists the counters with
+// the most shards and can look up one counter's current bucket
+func counters(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	log.Debugf(ctx, "counters called")
+
+	p := CountersPage{MaxShards: MaxCounterShards}
+
+	if !initPage(ctx, w, r, &p.Page) {
+		return
+	}
+
+	q := datastore.NewQuery(configKind).Order("-Shards").
+		Limit(countersPageLimit)
+	var configs []counterConfig
+	if _, err := q.GetAll(ctx, &configs); err != nil &&
+		!isErrFieldMismatch(err) {
+		pageFail(w, err.Error())
+		return
+	}
+
+	var keys []CounterKey
+	var shards []int
+	for _, cfg := range configs {
+		// Counters from before dimensions have no metric
+		if cfg.Metric == "" {
+			continue
+		}
+		keys = append(keys, CounterKey{
+			Metric: cfg.Metric,
+			Queue:  cfg.Queue,
+			URL:    cfg.URL,
+			Period: cfg.Period,
+			Bucket: cfg.Bucket.UTC(),
+		})
+		shards = append(shards, cfg.Shards)
+	}
+
+	v := r.URL.Query()
+	p.Metric = v.Get("metric")
+	p.Queue = v.Get("queue")
+	p.URL = v.Get("url")
+	p.Period = v.Get("period")
+	if p.Period == "" {
+		p.Period = PeriodAll
+	}
+	if p.Metric != "" {
+		k := newCounterKey(p.Metric, p.Queue, p.URL, p.Period,
+			time.Now().UTC())
+		var cfg counterConfig
+		ckey := datastore.NewKey(ctx, configKind, k.Name(), 0, nil)
+		err := datastore.Get(ctx, ckey, &cfg)
+		if err != nil && err != datastore.ErrNoSuchEntity &&
+			!isErrFieldMismatch(err) {
+			pageFail(w, err.Error())
+			return
+		}
+		if cfg.Shards < 1 {
+			cfg.Shards = defaultShards
+		}
+		keys = append(keys, k)
+		shards = append(shards, cfg.Shards)
+	}
+
+	totals, _, err := countTotals(ctx, configKind, keys, shards,
+		make([]int64, len(keys)), "")
+	if err != nil {
+		pageFail(w, err.Error())
+		return
+	}
+	for i, t := range totals {
+		row := CounterRow{CounterKey: t.CounterKey, Name: t.Name,
+			Shards: shards[i], Total: t.Total}
+		if p.Metric != "" && i == len(totals)-1 {
+			p.Lookup = &row
+			break
+		}
+		p.Counters = append(p.Counters, row)
+	}
+
+	p.Title = "Loop PushQ Admin Console - Counters"
+
+	renderPage(w, r, p, "counters.html")
+}
+
+// setCounterShards is called from JS on the counters page.  It raises the
+// shard count of a counter.  Shard counts can't be lowered, since the
+// counts in the shards that were dropped would be missed.
+func setCounterShards(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	log.Debugf(ctx, "setCounterShards called")
+
+	var p Page
+	if !initPage(ctx, w, r, &p) {
+		return
+	}
+
+	// Decode the POST body
+	decoder := json.NewDecoder(r.Body)
+	var c CounterRow
+	err := decoder.Decode(&c)
+	if err != nil {
+		failJSON(w, err.Error())
+		return
+	}
+
+	if c.Metric == "" {
+		failJSON(w, "Metric is required")
+		return
+	}
+	switch c.Period {
+	case PeriodAll, PeriodHour, PeriodDay:
+	default:
+		failJSON(w, "Period must be all, hour or day")
+		return
+	}
+	if c.Shards < 1 || c.Shards > MaxCounterShards {
+		failJSON(w, fmt.Sprintf("Shards must be from 1 to %d",
+			MaxCounterShards))
+		return
+	}
+	k := c.CounterKey
+	k.Bucket = bucketStart(k.Period, k.Bucket)
+
+	var cfg counterConfig
+	ckey := datastore.NewKey(ctx, configKind, k.Name(), 0, nil)
+	err = datastore.Get(ctx, ckey, &cfg)
+	if err != nil && err != datastore.ErrNoSuchEntity &&
+		!isErrFieldMismatch(err) {
+		failJSON(w, err.Error())
+		return
+	}
+	if cfg.Shards < 1 {
+		cfg.Shards = defaultShards
+	}
+	if c.Shards < cfg.Shards {
+		failJSON(w, fmt.Sprintf("The counter has %d shards, which can't "+
+			"be lowered", cfg.Shards))
+		return
+	}
+
+	if err := IncreaseCounterShards(ctx, k, c.Shards); err != nil {
+		failJSON(w, err.Error())
+		return
+	}
+
+	log.Infof(ctx, "%s set counter %s to %d shards", p.Name, k.Name(),
+		c.Shards)
+
+	okJSON(w, k.Name())
+}
+
+// AlertsPage is a view model for the alert rules page
+type AlertsPage struct {
+	Page
+	Rules   []AlertRule
+	Queues  []QueueDef
+	Webhook string
+}
+
+// alerts renders the alert rules admin page
+func alerts(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	log.Debugf(ctx, "alerts called")
+
+	p := AlertsPage{Queues: QueueDefs, Webhook: os.Getenv(AlertWebhookEnv)}
+
+	if !initPage(ctx, w, r, &p.Page) {
+		return
+	}
+
+	q := datastore.NewQuery(AlertRuleKind).Order("Queue")
+	keys, err := q.GetAll(ctx, &p.Rules)
+	if err != nil && !isErrFieldMismatch(err) {
+		pageFail(w, err.Error())
+		return
+	}
+	for i, k := range keys {
+		p.Rules[i].ID = k.IntID()
+	}
+
+	p.Title = "Loop PushQ Admin Console - Alerts"
+
+	renderPage(w, r, p, "alerts.html")
+}
+
+// saveAlertRule is called from JS on the alerts page.  It creates a rule,
+// or replaces the settings of the rule with the ID.  A rule's state is
+// kept when it is edited.
+func saveAlertRule(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	log.Debugf(ctx, "saveAlertRule called")
+
+	var p Page
+	if !initPage(ctx, w, r, &p) {
+		return
+	}
+
+	// Decode the POST body
+	decoder := json.NewDecoder(r.Body)
+	var rule AlertRule
+	err := decoder.Decode(&rule)
+	if err != nil {
+		failJSON(w, err.Error())
+		return
+	}
+
+	if fields := validateAlertRule(&rule); len(fields) > 0 {
+		failJSON(w, fields[0].Message)
+		return
+	}
+
+	k := datastore.NewIncompleteKey(ctx, AlertRuleKind, nil)
+	if rule.ID != 0 {
+		k = datastore.NewKey(ctx, AlertRuleKind, "", rule.ID, nil)
+	}
+	err = datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		if rule.ID != 0 {
+			var stored AlertRule
+			err := datastore.Get(ctx, k, &stored)
+			if err != nil && !isErrFieldMismatch(err) {
+				return err
+			}
+			rule.Firing = stored.Firing
+			rule.FiredAt = stored.FiredAt
+			rule.Value = stored.Value
+			rule.EvaluatedAt = stored.EvaluatedAt
+		}
+		rule.UpdatedBy = p.Name
+		rule.UpdatedOn = time.Now().UTC()
+		var err error
+		k, err = datastore.Put(ctx, k, &rule)
+		return err
+	}, nil)
+	if err != nil {
+		failJSON(w, err.Error())
+		return
+	}
+
+	okJSON(w, k.IntID())
+}
+
+// delAlertRule is called from JS on the alerts page.  It deletes a rule
+// without sending a resolved notification.
+func delAlertRule(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	log.Debugf(ctx, "delAlertRule called")
+
+	var p Page
+	if !initPage(ctx, w, r, &p) {
+		return
+	}
+
+	// Decode the POST body
+	decoder := json.NewDecoder(r.Body)
+	var rule AlertRule
+	err := decoder.Decode(&rule)
+	if err != nil {
+		failJSON(w, err.Error())
+		return
+	}
+
+	k := datastore.NewKey(ctx, AlertRuleKind, "", rule.ID, nil)
+	if err := datastore.Delete(ctx, k); err != nil {
+		failJSON(w, err.Error())
+		return
+	}
+
+	okJSON(w, rule.ID)
+}
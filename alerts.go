@@ -0,0 +1,429 @@
+package pushq
+
+// This file has alert rules.  A cron job evaluates each rule over the
+// hourly counters or the queue's backlog.  When a rule starts or stops
+// firing, a notification is enqueued to its webhook through PushQ's own
+// queue, in the same transaction that records the change, so each change
+// is sent once.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+)
+
+// AlertRuleKind is the datastore Kind for alert rules
+const AlertRuleKind string = "AlertRule"
+
+// AlertWebhookEnv is the environment variable with the webhook for rules
+// that don't set their own
+const AlertWebhookEnv string = "PUSHQ_ALERT_WEBHOOK"
+
+// AlertQueueEnv is the environment variable with the queue notifications
+// are sent through.  The default is DefaultAlertQueue.
+const AlertQueueEnv string = "PUSHQ_ALERT_QUEUE"
+
+// DefaultAlertQueue is the queue notifications are sent through
+const DefaultAlertQueue string = "default"
+
+// DefaultAlertWindowMinutes is the window for rules that don't set one
+const DefaultAlertWindowMinutes int = 60
+
+// Alert rule types
+const (
+	// AlertErrorRate fires when the percent of callbacks that failed is
+	// above the threshold
+	AlertErrorRate = "errorRate"
+
+	// AlertLatency fires when the percentile of callback durations is
+	// above the threshold in milliseconds
+	AlertLatency = "latency"
+
+	// AlertBacklog fires when the queue has more tasks than the threshold
+	AlertBacklog = "backlog"
+)
+
+// Alert notification statuses
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// AlertRule is an alert on a queue or a URL.  Error rate and latency are
+// read from the hourly counters, so the window is whole hours, and is
+// rounded out to the start of the hour it begins in.
+type AlertRule struct {
+	ID            int64   `datastore:"-" json:"id"`
+	Queue         string  `json:"queue"`
+	URL           string  `json:"url"`
+	Type          string  `json:"type"`
+	Threshold     float64 `json:"threshold"`
+	WindowMinutes int     `json:"windowMinutes"`
+
+	// Percentile is for latency rules, e.g. 95
+	Percentile float64 `json:"percentile"`
+
+	// MinCount is the number of callbacks in the window before error rate
+	// and latency rules can fire
+	MinCount int64 `json:"minCount"`
+
+	// Webhook is the URL notifications are sent to.  If it is blank,
+	// PUSHQ_ALERT_WEBHOOK is used.
+	Webhook string `json:"webhook"`
+
+	// The rule's state, set by the evaluator
+	Firing      bool      `json:"firing"`
+	FiredAt     time.Time `json:"firedAt"`
+	Value       float64   `json:"value"`
+	EvaluatedAt time.Time `json:"evaluatedAt"`
+
+	UpdatedBy string    `json:"updatedBy"`
+	UpdatedOn time.Time `json:"updatedOn"`
+}
+
+// AlertNotification is the payload of the task sent to the webhook
+type AlertNotification struct {
+	RuleID        int64     `json:"ruleId"`
+	Status        string    `json:"status"`
+	Queue         string    `json:"queue,omitempty"`
+	URL           string    `json:"url,omitempty"`
+	Type          string    `json:"type"`
+	Threshold     float64   `json:"threshold"`
+	Percentile    float64   `json:"percentile,omitempty"`
+	WindowMinutes int       `json:"windowMinutes,omitempty"`
+	Value         float64   `json:"value"`
+	FiredAt       time.Time `json:"firedAt"`
+	At            time.Time `json:"at"`
+}
+
+// validateAlertRule checks a rule and fills in its defaults
+func validateAlertRule(rule *AlertRule) []FieldError {
+	var fields []FieldError
+
+	if rule.Queue == "" && rule.URL == "" {
+		fields = append(fields, FieldError{"queue", FieldRequired,
+			"queue or url is required"})
+	}
+	if rule.Queue != "" && rule.URL != "" {
+		fields = append(fields, FieldError{"url", FieldNotAllowed,
+			"Counters are kept by queue or by URL, not both"})
+	}
+	if rule.Queue != "" {
+		if _, ok := getQueueDef(rule.Queue); !ok {
+			fields = append(fields, FieldError{"queue", FieldInvalid,
+				"Invalid QueueName"})
+		}
+	}
+
+	switch rule.Type {
+	case AlertErrorRate:
+		if rule.Threshold < 0 || rule.Threshold >= 100 {
+			fields = append(fields, FieldError{"threshold", FieldInvalid,
+				"threshold must be a percent from 0 to 100"})
+		}
+	case AlertLatency:
+		if rule.Percentile == 0 {
+			rule.Percentile = 95
+		}
+		if rule.Percentile <= 0 || rule.Percentile >= 100 {
+			fields = append(fields, FieldError{"percentile", FieldInvalid,
+				"percentile must be from 0 to 100"})
+		}
+		if rule.Threshold <= 0 {
+			fields = append(fields, FieldError{"threshold", FieldInvalid,
+				"threshold must be more than 0 ms"})
+		}
+	case AlertBacklog:
+		if rule.URL != "" {
+			fields = append(fields, FieldError{"url", FieldNotAllowed,
+				"Backlog rules are for queues"})
+		}
+		if rule.Threshold < 0 {
+			fields = append(fields, FieldError{"threshold", FieldInvalid,
+				"threshold can't be negative"})
+		}
+	default:
+		fields = append(fields, FieldError{"type", FieldInvalid,
+			"type must be errorRate, latency or backlog"})
+	}
+
+	if rule.WindowMinutes == 0 {
+		rule.WindowMinutes = DefaultAlertWindowMinutes
+	}
+	if rule.WindowMinutes < 0 || rule.WindowMinutes > 24*60 ||
+		rule.WindowMinutes%60 != 0 {
+		fields = append(fields, FieldError{"windowMinutes", FieldInvalid,
+			"windowMinutes must be whole hours, from 60 to 1440"})
+	}
+	if rule.MinCount < 0 {
+		fields = append(fields, FieldError{"minCount", FieldInvalid,
+			"minCount can't be negative"})
+	}
+	if rule.Webhook == "" && os.Getenv(AlertWebhookEnv) == "" {
+		fields = append(fields, FieldError{"webhook", FieldRequired,
+			"webhook is required when " + AlertWebhookEnv + " is not set"})
+	} else if rule.Webhook != "" && !isCallbackURL(rule.Webhook) {
+		fields = append(fields, FieldError{"webhook", FieldInvalid,
+			"webhook must be an absolute http or https URL"})
+	}
+	return fields
+}
+
+// alertWindowStart returns the start of the hourly bucket that holds the
+// start of the rule's window, so the window always covers at least the
+// last WindowMinutes, and less than an hour more
+func alertWindowStart(rule *AlertRule, now time.Time) time.Time {
+	window := time.Duration(rule.WindowMinutes) * time.Minute
+	return bucketStart(PeriodHour, now.Add(-window))
+}
+
+// alertValue evaluates a rule.  It returns the rule's value and whether
+// there were enough callbacks in the window to judge it.
+func alertValue(ctx context.Context, rule *AlertRule,
+	now time.Time) (float64, bool, error) {
+
+	if rule.Type == AlertBacklog {
+		stats, err := taskqueue.QueueStats(ctx, []string{rule.Queue})
+		if err != nil {
+			return 0, false, err
+		}
+		return float64(stats[0].Tasks), true, nil
+	}
+
+	from := alertWindowStart(rule, now)
+	counts, err := hourlyCounts(ctx, rule.Queue, rule.URL, from, now)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if rule.Type == AlertErrorRate {
+		errs, ok := counts[ErrCt], counts[AvgTotalCt]
+		total := errs + ok
+		if total == 0 {
+			return 0, false, nil
+		}
+		return 100 * float64(errs) / float64(total), total >= rule.MinCount,
+			nil
+	}
+
+	hist := latencyHistogram(counts)
+	stats := latencyStats(hist, 0)
+	if stats.Count == 0 {
+		return 0, false, nil
+	}
+	return latencyPercentile(hist, rule.Percentile/100, 0),
+		stats.Count >= rule.MinCount, nil
+}
+
+// alertTask builds the notification task for a rule's change of status
+func alertTask(ctx context.Context, rule *AlertRule, status string,
+	now time.Time) (*Task, error) {
+
+	n := AlertNotification{
+		RuleID:        rule.ID,
+		Status:        status,
+		Queue:         rule.Queue,
+		URL:           rule.URL,
+		Type:          rule.Type,
+		Threshold:     rule.Threshold,
+		Percentile:    rule.Percentile,
+		WindowMinutes: rule.WindowMinutes,
+		Value:         rule.Value,
+		FiredAt:       rule.FiredAt,
+		At:            now,
+	}
+	if rule.Type == AlertBacklog {
+		n.WindowMinutes = 0
+	}
+	if rule.Type != AlertLatency {
+		n.Percentile = 0
+	}
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return nil, err
+	}
+
+	task := &Task{
+		URL:       rule.Webhook,
+		Payload:   string(payload),
+		QueueName: os.Getenv(AlertQueueEnv),
+		Headers: []TaskHeader{
+			TaskHeader{Name: "Content-Type", Value: "application/json"},
+		},
+	}
+	if task.URL == "" {
+		task.URL = os.Getenv(AlertWebhookEnv)
+	}
+	if task.QueueName == "" {
+		task.QueueName = DefaultAlertQueue
+	}
+	if task.TaskName, err = newTaskName(); err != nil {
+		return nil, err
+	}
+
+	var qc QueueConfig
+	ok, err := isValidQueue(ctx, &qc, task.QueueName)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("Invalid %s: %s", AlertQueueEnv,
+			task.QueueName)
+	}
+	fields := validateTask(task)
+	fields = append(fields, applyQueuePolicy(task, &qc)...)
+	if len(fields) > 0 {
+		return nil, fmt.Errorf("Invalid alert task: %s: %s", fields[0].Field,
+			fields[0].Message)
+	}
+	return task, nil
+}
+
+// addAlertTask adds the notification to the queue.  In a transaction,
+// the task is only added if the transaction commits.
+func addAlertTask(ctx context.Context, task *Task) error {
+	queued := *task
+	kr, err := getKeyring()
+	if err == nil && kr != nil {
+		err = sealTask(kr, &queued)
+	}
+	if err != nil {
+		return err
+	}
+	jsonb, err := json.Marshal(queued)
+	if err != nil {
+		return err
+	}
+
+	// Transactional tasks can't be named
+	t := taskqueue.Task{}
+	t.Path = "/callback"
+	t.Payload = jsonb
+	if task.Retry != nil {
+		t.RetryOptions = task.Retry.RetryOptions()
+	}
+	_, err = taskqueue.Add(ctx, &t, task.QueueName)
+	return err
+}
+
+// alertChange returns whether a rule with the value is firing, and whether
+// that is a change.  A rule without enough callbacks to judge resolves.
+func alertChange(rule *AlertRule, value float64, enough bool) (bool, bool) {
+	firing := enough && value > rule.Threshold
+	return firing, firing != rule.Firing
+}
+
+// evaluateAlert checks one rule, and notifies its webhook if the rule
+// started or stopped firing
+func evaluateAlert(ctx context.Context, key *datastore.Key,
+	rule *AlertRule, now time.Time) error {
+
+	value, enough, err := alertValue(ctx, rule, now)
+	if err != nil {
+		return err
+	}
+	firing, changed := alertChange(rule, value, enough)
+
+	status := AlertResolved
+	if firing {
+		status = AlertFiring
+	}
+	var task *Task
+	if changed {
+		if firing {
+			rule.FiredAt = now
+		}
+		rule.Value = value
+		if task, err = alertTask(ctx, rule, status, now); err != nil {
+			return err
+		}
+	}
+
+	err = datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var stored AlertRule
+		err := datastore.Get(ctx, key, &stored)
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		if err != nil && !isErrFieldMismatch(err) {
+			return err
+		}
+
+		// Another run already sent this change
+		if stored.Firing == firing {
+			task = nil
+		}
+		if task != nil {
+			if err = addAlertTask(ctx, task); err != nil {
+				return err
+			}
+			if firing {
+				stored.FiredAt = now
+			}
+		}
+		stored.Firing = firing
+		stored.Value = value
+		stored.EvaluatedAt = now
+		_, err = datastore.Put(ctx, key, &stored)
+		return err
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	if task != nil {
+		log.Infof(ctx, "Alert rule %d is %s: %s %v", key.IntID(), status,
+			rule.Type, value)
+		var b CounterBatch
+		addCounters(&b, EnqCt, "", "", now, 1)
+		addCounters(&b, EnqCt, task.QueueName, "", now, 1)
+		addCounters(&b, EnqCt, "", task.URL, now, 1)
+		commitCounters(ctx, &b, now)
+		recordURL(ctx, task.URL)
+	}
+	return nil
+}
+
+// evaluateAlerts is called by cron.  It evaluates every alert rule.
+func evaluateAlerts(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	log.Debugf(ctx, "evaluateAlerts called")
+
+	if !isCronRequest(ctx, r) {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	var rules []AlertRule
+	keys, err := datastore.NewQuery(AlertRuleKind).GetAll(ctx, &rules)
+	if err != nil && !isErrFieldMismatch(err) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// One bad rule doesn't stop the others
+	now := time.Now().UTC()
+	failed := 0
+	for i := range rules {
+		rules[i].ID = keys[i].IntID()
+		if err := evaluateAlert(ctx, keys[i], &rules[i], now); err != nil {
+			log.Errorf(ctx, "Unable to evaluate alert rule %d: %s",
+				rules[i].ID, err.Error())
+			failed++
+		}
+	}
+	log.Infof(ctx, "Evaluated %d alert rules, %d failed", len(rules), failed)
+	if failed > 0 {
+		http.Error(w, "Some alert rules failed", http.StatusInternalServerError)
+	}
+}
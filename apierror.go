@@ -0,0 +1,124 @@
+package pushq
+
+// This file has the JSON error responses for the REST API, and the
+// validation of submitted tasks that produces field errors.
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Error codes returned in APIError.Code
+const (
+	ErrCodeUnauthorized = "unauthorized"
+	ErrCodeForbidden    = "forbidden"
+	ErrCodeInvalidJSON  = "invalid_json"
+	ErrCodeValidation   = "validation_failed"
+	ErrCodeQueuePaused  = "queue_paused"
+	ErrCodeEnqueue      = "enqueue_failed"
+	ErrCodeInternal     = "internal_error"
+)
+
+// Field error codes returned in FieldError.Code
+const (
+	FieldRequired   = "required"
+	FieldInvalid    = "invalid"
+	FieldNotAllowed = "not_allowed"
+	FieldTooLarge   = "too_large"
+)
+
+// FieldError describes a problem with one field of a submitted task
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// APIError is a machine-readable error from the REST API
+type APIError struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+// APIErrorResponse is serialized to json for REST API errors
+type APIErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// writeAPIError writes an error response with the given status
+func writeAPIError(w http.ResponseWriter, status int, e APIError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(APIErrorResponse{Error: e})
+}
+
+// apiError writes an error response without field errors
+func apiError(w http.ResponseWriter, status int, code string, message string) {
+	writeAPIError(w, status, APIError{Code: code, Message: message})
+}
+
+// apiFieldErrors writes a 400 response listing the invalid fields
+func apiFieldErrors(w http.ResponseWriter, fields []FieldError) {
+	writeAPIError(w, http.StatusBadRequest, APIError{
+		Code:    ErrCodeValidation,
+		Message: "Invalid task",
+		Fields:  fields,
+	})
+}
+
+// isCallbackURL reports whether s is an absolute http or https URL
+func isCallbackURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.Host != "" &&
+		(u.Scheme == "http" || u.Scheme == "https")
+}
+
+// validateTask checks the fields of a submitted task that don't depend
+// on its queue's config.
+func validateTask(task *Task) []FieldError {
+	var fields []FieldError
+
+	if task.URL == "" {
+		fields = append(fields, FieldError{"url", FieldRequired,
+			"url is required"})
+	} else if !isCallbackURL(task.URL) {
+		fields = append(fields, FieldError{"url", FieldInvalid,
+			"url must be an absolute http or https URL"})
+	}
+
+	if task.QueueName == "" {
+		fields = append(fields, FieldError{"queueName", FieldRequired,
+			"queueName is required"})
+	}
+
+	// Only the server seals tasks, after checking the clear text
+	if task.Sealed != nil {
+		fields = append(fields, FieldError{"sealed", FieldNotAllowed,
+			"sealed can't be sent to enq"})
+	}
+
+	if task.DelaySeconds < 0 {
+		fields = append(fields, FieldError{"delaySeconds", FieldInvalid,
+			"delaySeconds can't be negative"})
+	}
+
+	if task.TimeoutSeconds < 0 {
+		fields = append(fields, FieldError{"timeoutSeconds", FieldInvalid,
+			"timeoutSeconds can't be negative"})
+	}
+
+	for _, h := range task.Headers {
+		if h.Name == "" || strings.ContainsAny(h.Name, " \t\r\n:") {
+			fields = append(fields, FieldError{"headers", FieldInvalid,
+				"Invalid header name: " + h.Name})
+		} else if strings.ContainsAny(h.Value, "\r\n") {
+			fields = append(fields, FieldError{"headers", FieldInvalid,
+				"Invalid value for header " + h.Name})
+		}
+	}
+
+	return fields
+}
@@ -0,0 +1,13 @@
+// Command pushq runs PushQ on App Engine.  The routes are registered by
+// the pushq package when it is imported.
+package main
+
+import (
+	"google.golang.org/appengine"
+
+	_ "github.com/LoopLLC/PushQ"
+)
+
+func main() {
+	appengine.Main()
+}
@@ -3,41 +3,175 @@
 // license that can be found in the LICENSE file.
 
 // This file has a simple implemetation of datastore shard counters.
+// Counters are identified by their dimensions: a metric, an optional queue
+// or URL, and a period with its time bucket.
 
 package pushq
 
 import (
 	"fmt"
 	"math/rand"
+	"net/url"
+	"strings"
+	"time"
 
 	"golang.org/x/net/context"
 
+	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/memcache"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Counter periods.  Buckets start on the hour, day or month in UTC.
+// Month buckets are only made by rolling up old day buckets.
+const (
+	PeriodAll   = "all"
+	PeriodHour  = "hour"
+	PeriodDay   = "day"
+	PeriodMonth = "month"
 )
 
+// counterPeriods are the periods each event is counted in
+var counterPeriods = []string{PeriodAll, PeriodDay, PeriodHour}
+
+// CounterKey identifies a counter.  A blank Queue and URL counts events
+// for all queues and URLs.  Bucket is zero for PeriodAll.
+type CounterKey struct {
+	Metric string
+	Queue  string
+	URL    string
+	Period string
+	Bucket time.Time
+}
+
+// bucketStart returns the start of the period's bucket that holds t
+func bucketStart(period string, t time.Time) time.Time {
+	t = t.UTC()
+	switch period {
+	case PeriodHour:
+		return t.Truncate(time.Hour)
+	case PeriodDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case PeriodMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Time{}
+}
+
+// nextBucket returns the start of the bucket after the one starting at b
+func nextBucket(period string, b time.Time) time.Time {
+	switch period {
+	case PeriodHour:
+		return b.Add(time.Hour)
+	case PeriodMonth:
+		return b.AddDate(0, 1, 0)
+	}
+	return b.AddDate(0, 0, 1)
+}
+
+// newCounterKey returns the key for the counter with the given
+// dimensions whose bucket holds t
+func newCounterKey(metric, queue, url, period string,
+	t time.Time) CounterKey {
+	return CounterKey{
+		Metric: metric,
+		Queue:  queue,
+		URL:    url,
+		Period: period,
+		Bucket: bucketStart(period, t),
+	}
+}
+
+// Name returns the canonical name of the counter, which is unique for
+// each set of dimensions.  The dimensions are escaped so that they can't
+// run into each other.
+func (k CounterKey) Name() string {
+	bucket := ""
+	switch k.Period {
+	case PeriodHour:
+		bucket = k.Bucket.UTC().Format("2006-01-02T15")
+	case PeriodDay:
+		bucket = k.Bucket.UTC().Format(ISO8601D)
+	case PeriodMonth:
+		bucket = k.Bucket.UTC().Format("2006-01")
+	}
+	return strings.Join([]string{
+		url.QueryEscape(k.Metric),
+		url.QueryEscape(k.Queue),
+		url.QueryEscape(k.URL),
+		k.Period,
+		bucket,
+	}, "|")
+}
+
 type counterConfig struct {
 	Shards int
+
+	// Migrated is set on counters from before dimensions once their
+	// total has been added to the new key, see countermigrate.go
+	Migrated bool `datastore:",noindex"`
+
+	// The dimensions of the counter, for listing counters
+	Metric string
+	Queue  string
+	URL    string
+	Period string
+	Bucket time.Time
 }
 
+// counterShard is also used for rollups, which hold the count of a
+// closed bucket in one entity.  See rollup.go.
 type counterShard struct {
 	Name  string
 	Count int64
+
+	// The dimensions of the counter, for time series queries
+	Metric string
+	Queue  string
+	URL    string
+	Period string
+	Bucket time.Time
+}
+
+// setKey sets the name and dimensions of the shard
+func (s *counterShard) setKey(k CounterKey) {
+	s.Name = k.Name()
+	s.Metric = k.Metric
+	s.Queue = k.Queue
+	s.URL = k.URL
+	s.Period = k.Period
+	s.Bucket = k.Bucket
+}
+
+// key returns the counter the shard belongs to
+func (s *counterShard) key() CounterKey {
+	return CounterKey{
+		Metric: s.Metric,
+		Queue:  s.Queue,
+		URL:    s.URL,
+		Period: s.Period,
+		Bucket: s.Bucket.UTC(),
+	}
 }
 
 const (
 	defaultShards = 20
 	configKind    = "CounterConfig"
 	shardKind     = "CounterShard"
+	rollupKind    = "CounterRollup"
 )
 
 func memcacheKey(name string) string {
 	return shardKind + ":" + name
 }
 
-// Count retrieves the value of the named counter.
-func Count(ctx context.Context, name string) (int64, error) {
+// Count retrieves the value of the counter.
+func Count(ctx context.Context, k CounterKey) (int64, error) {
 	var total int64
+	name := k.Name()
 	mkey := memcacheKey(name)
 	if _, err := memcache.JSON.Get(ctx, mkey, &total); err == nil {
 		return total, nil
@@ -49,11 +183,23 @@ func Count(ctx context.Context, name string) (int64, error) {
 		if err == datastore.Done {
 			break
 		}
-		if err != nil {
+		if err != nil && !isErrFieldMismatch(err) {
 			return total, err
 		}
 		total += s.Count
 	}
+	if k.Period != PeriodAll {
+		// Closed buckets are rolled up, though shards for late
+		// increments can be left until the next compaction.
+		var rollup counterShard
+		rkey := datastore.NewKey(ctx, rollupKind, name, 0, nil)
+		err := datastore.Get(ctx, rkey, &rollup)
+		if err != nil && err != datastore.ErrNoSuchEntity &&
+			!isErrFieldMismatch(err) {
+			return total, err
+		}
+		total += rollup.Count
+	}
 	memcache.JSON.Set(ctx, &memcache.Item{
 		Key:        mkey,
 		Object:     &total,
@@ -62,55 +208,264 @@ func Count(ctx context.Context, name string) (int64, error) {
 	return total, nil
 }
 
-// Increment increments the named counter.
-func Increment(ctx context.Context, name string, by int64) error {
+// Increment increments the counter.
+func Increment(ctx context.Context, k CounterKey, by int64) (err error) {
+	name := k.Name()
+	ctx, span := startSpan(ctx, "counter.Increment",
+		trace.WithAttributes(attribute.String("pushq.counter", name)))
+	defer func() {
+		if err != nil {
+			spanError(span, err)
+		}
+		span.End()
+	}()
+
 	// Get counter config.
 	var cfg counterConfig
 	ckey := datastore.NewKey(ctx, configKind, name, 0, nil)
-	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+	err = datastore.RunInTransaction(ctx, func(ctx context.Context) error {
 		err := datastore.Get(ctx, ckey, &cfg)
 		if err == datastore.ErrNoSuchEntity {
-			cfg.Shards = defaultShards
+			cfg = newCounterConfig(k)
 			_, err = datastore.Put(ctx, ckey, &cfg)
 		}
 		return err
 	}, nil)
-	if err != nil {
+	if err != nil && !isErrFieldMismatch(err) {
 		return err
 	}
-	var s counterShard
-	err = datastore.RunInTransaction(ctx, func(ctx context.Context) error {
-		shardName := fmt.Sprintf("%s-shard%d", name, rand.Intn(cfg.Shards))
+	if err = incrementShard(ctx, k, cfg.Shards, by); err != nil {
+		return err
+	}
+	memcache.IncrementExisting(ctx, memcacheKey(name), by)
+	return nil
+}
+
+// incrementShard adds by to a random shard of the counter in a
+// transaction of its own, and notes the contention it ran into
+func incrementShard(ctx context.Context, k CounterKey, shards int,
+	by int64) error {
+
+	if shards < 1 {
+		shards = defaultShards
+	}
+	name := k.Name()
+	attempts := 0
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		attempts++
+		shardName := fmt.Sprintf("%s-shard%d", name, rand.Intn(shards))
 		key := datastore.NewKey(ctx, shardKind, shardName, 0, nil)
+		var s counterShard
 		err := datastore.Get(ctx, key, &s)
 		// A missing entity and a present entity will both work.
 		if err != nil && err != datastore.ErrNoSuchEntity {
 			return err
 		}
-		s.Name = name
+		s.setKey(k)
 		s.Count += by
 		_, err = datastore.Put(ctx, key, &s)
 		return err
 	}, nil)
-	if err != nil {
-		return err
+	if n := contention(attempts, err); n > 0 {
+		noteContention(ctx, k, shards, n)
 	}
-	memcache.IncrementExisting(ctx, memcacheKey(name), 1)
-	return nil
+	return err
+}
+
+// CounterBatch collects increments so they can be applied together with
+// IncrementMulti.  The zero value is an empty batch.
+type CounterBatch struct {
+	keys   []CounterKey
+	deltas map[string]int64
 }
 
-// IncreaseCounterShards increases the number of shards for the named
+// Add adds by to the increment for the counter
+func (b *CounterBatch) Add(k CounterKey, by int64) {
+	if b.deltas == nil {
+		b.deltas = map[string]int64{}
+	}
+	name := k.Name()
+	if _, ok := b.deltas[name]; !ok {
+		b.keys = append(b.keys, k)
+	}
+	b.deltas[name] += by
+}
+
+// Len returns the number of counters in the batch
+func (b *CounterBatch) Len() int {
+	return len(b.keys)
+}
+
+// split returns the batch in order as batches of up to n counters
+func (b *CounterBatch) split(n int) []*CounterBatch {
+	var parts []*CounterBatch
+	for start := 0; start < b.Len(); start += n {
+		end := start + n
+		if end > b.Len() {
+			end = b.Len()
+		}
+		part := &CounterBatch{}
+		for _, k := range b.keys[start:end] {
+			part.Add(k, b.deltas[k.Name()])
+		}
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+// maxXGGroups is the most entity groups one cross-group transaction can use
+const maxXGGroups int = 25
+
+// IncrementMulti increments all the counters in the batch.  Configs are
+// read with one GetMulti, and a random shard of each counter is updated in
+// cross-group transactions of up to 25 counters.  A group that can't
+// commit on its first attempt isn't retried as a whole; its counters are
+// retried one at a time, so one contended counter can't hold up the rest.
+// If it fails part way, the increments that committed are not undone.
+func IncrementMulti(ctx context.Context, b *CounterBatch) error {
+	_, err := incrementBatch(ctx, b)
+	return err
+}
+
+// incrementBatch is IncrementMulti, and also returns the increments that
+// were not applied.  The rest of the batch was committed.
+func incrementBatch(ctx context.Context, b *CounterBatch) (
+	failed *CounterBatch, err error) {
+
+	failed = &CounterBatch{}
+	if b.Len() == 0 {
+		return failed, nil
+	}
+	ctx, span := startSpan(ctx, "counter.IncrementMulti",
+		trace.WithAttributes(attribute.Int("pushq.counters", b.Len())))
+	defer func() {
+		if err != nil {
+			spanError(span, err)
+		}
+		span.End()
+	}()
+
+	names := make([]string, b.Len())
+	ckeys := make([]*datastore.Key, b.Len())
+	for i, k := range b.keys {
+		names[i] = k.Name()
+		ckeys[i] = datastore.NewKey(ctx, configKind, names[i], 0, nil)
+	}
+
+	// Get the counter configs, and create the missing ones
+	cfgs := make([]counterConfig, b.Len())
+	var missing []int
+	err = datastore.GetMulti(ctx, ckeys, cfgs)
+	if me, ok := err.(appengine.MultiError); ok {
+		for i, e := range me {
+			if e == datastore.ErrNoSuchEntity {
+				missing = append(missing, i)
+			} else if e != nil && !isErrFieldMismatch(e) {
+				return b, e
+			}
+		}
+	} else if err != nil && !isErrFieldMismatch(err) {
+		return b, err
+	}
+	if len(missing) > 0 {
+		mkeys := make([]*datastore.Key, len(missing))
+		mks := make([]CounterKey, len(missing))
+		mcfgs := make([]counterConfig, len(missing))
+		for j, i := range missing {
+			mkeys[j] = ckeys[i]
+			mks[j] = b.keys[i]
+			mcfgs[j] = newCounterConfig(b.keys[i])
+		}
+		if err = inheritShards(ctx, mks, mcfgs); err != nil {
+			return b, err
+		}
+		if _, err = datastore.PutMulti(ctx, mkeys, mcfgs); err != nil {
+			return b, err
+		}
+		for j, i := range missing {
+			cfgs[i] = mcfgs[j]
+		}
+	}
+
+	opts := &datastore.TransactionOptions{XG: true, Attempts: 1}
+	for start := 0; start < b.Len(); start += maxXGGroups {
+		end := start + maxXGGroups
+		if end > b.Len() {
+			end = b.Len()
+		}
+		skeys := make([]*datastore.Key, 0, end-start)
+		counts := make([]int, 0, end-start)
+		for i := start; i < end; i++ {
+			shards := cfgs[i].Shards
+			if shards < 1 {
+				shards = defaultShards
+			}
+			shardName := fmt.Sprintf("%s-shard%d", names[i], rand.Intn(shards))
+			skeys = append(skeys, datastore.NewKey(ctx, shardKind, shardName,
+				0, nil))
+			counts = append(counts, shards)
+		}
+		gerr := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+			// A missing entity and a present entity will both work.
+			shards, err := getCounterShards(ctx, skeys)
+			if err != nil {
+				return err
+			}
+			for j := range shards {
+				shards[j].setKey(b.keys[start+j])
+				shards[j].Count += b.deltas[names[start+j]]
+			}
+			_, err = datastore.PutMulti(ctx, skeys, shards)
+			return err
+		}, opts)
+		if gerr == nil {
+			continue
+		}
+
+		// A group can't tell which of its counters was contended, so
+		// contention is only noted by the retries of single counters
+		for i := start; i < end; i++ {
+			by := b.deltas[names[i]]
+			if e := incrementShard(ctx, b.keys[i], counts[i-start],
+				by); e != nil {
+				failed.Add(b.keys[i], by)
+				err = e
+			}
+		}
+	}
+
+	for _, name := range names {
+		if _, ok := failed.deltas[name]; !ok {
+			memcache.IncrementExisting(ctx, memcacheKey(name), b.deltas[name])
+		}
+	}
+	return failed, err
+}
+
+// newCounterConfig returns the config for a new counter
+func newCounterConfig(k CounterKey) counterConfig {
+	return counterConfig{
+		Shards: defaultShards,
+		Metric: k.Metric,
+		Queue:  k.Queue,
+		URL:    k.URL,
+		Period: k.Period,
+		Bucket: k.Bucket,
+	}
+}
+
+// IncreaseCounterShards increases the number of shards for the
 // counter to n. It will never decrease the number of shards.
-func IncreaseCounterShards(ctx context.Context, name string, n int) error {
-	ckey := datastore.NewKey(ctx, configKind, name, 0, nil)
+func IncreaseCounterShards(ctx context.Context, k CounterKey, n int) error {
+	ckey := datastore.NewKey(ctx, configKind, k.Name(), 0, nil)
 	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
 		var cfg counterConfig
 		mod := false
 		err := datastore.Get(ctx, ckey, &cfg)
 		if err == datastore.ErrNoSuchEntity {
-			cfg.Shards = defaultShards
+			cfg = newCounterConfig(k)
 			mod = true
-		} else if err != nil {
+		} else if err != nil && !isErrFieldMismatch(err) {
 			return err
 		}
 		if cfg.Shards < n {
@@ -124,18 +479,49 @@ func IncreaseCounterShards(ctx context.Context, name string, n int) error {
 	}, nil)
 }
 
-// GetAllCounterNames returns an array of all counter names
-func GetAllCounterNames(ctx context.Context) ([]string, error) {
-	var retval []string
-	q := datastore.NewQuery(configKind).KeysOnly()
-	var configKeys []*datastore.Key
-	var err error
-	if configKeys, err = q.GetAll(ctx, nil); err != nil {
-		return retval, err
+// CounterPoint is the count for one bucket of a time series
+type CounterPoint struct {
+	Bucket time.Time `json:"bucket"`
+	Count  int64     `json:"count"`
+}
+
+// CountSeries returns the counts for the buckets of k.Period that start
+// from from up to to, oldest first.  Buckets with no events have a zero
+// count.
+func CountSeries(ctx context.Context, k CounterKey,
+	from, to time.Time) ([]CounterPoint, error) {
+
+	from = bucketStart(k.Period, from)
+	var points []CounterPoint
+	index := map[time.Time]int{}
+	for b := from; b.Before(to); b = nextBucket(k.Period, b) {
+		index[b] = len(points)
+		points = append(points, CounterPoint{Bucket: b})
 	}
-	for _, key := range configKeys {
-		retval = append(retval, key.StringID())
+
+	// Open buckets are in shards, and closed buckets are rolled up
+	for _, kind := range []string{shardKind, rollupKind} {
+		q := datastore.NewQuery(kind).
+			Filter("Metric =", k.Metric).
+			Filter("Queue =", k.Queue).
+			Filter("URL =", k.URL).
+			Filter("Period =", k.Period).
+			Filter("Bucket >=", from).
+			Filter("Bucket <", to)
+		for t := q.Run(ctx); ; {
+			var s counterShard
+			_, err := t.Next(&s)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil && !isErrFieldMismatch(err) {
+				return nil, err
+			}
+			if i, ok := index[s.Bucket.UTC()]; ok {
+				points[i].Count += s.Count
+			}
+		}
 	}
 
-	return retval, nil
+	return points, nil
 }
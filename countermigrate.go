@@ -0,0 +1,191 @@
+package pushq
+
+// This file folds the lifetime counters from before counters had
+// dimensions into the new keys.  They were named by their metric with the
+// queue name or URL appended, and their configs have no Metric, so the
+// totals skip them.  The daily counters from then are not migrated.
+
+import (
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+// legacyMetrics are the metrics that were counted by queue and URL under
+// the old names
+var legacyMetrics = []string{EnqCt, ErrCt, AvgTotalCt, AvgAccumCt}
+
+// legacyCounterKeys returns the old names of the lifetime counters for the
+// queues and URLs, with the keys they fold into
+func legacyCounterKeys(queues, urls []string) map[string]CounterKey {
+	legacy := map[string]CounterKey{}
+	for _, metric := range legacyMetrics {
+		legacy[metric] = CounterKey{Metric: metric, Period: PeriodAll}
+		for _, queue := range queues {
+			legacy[metric+queue] = CounterKey{Metric: metric, Queue: queue,
+				Period: PeriodAll}
+		}
+		for _, url := range urls {
+			legacy[metric+url] = CounterKey{Metric: metric, URL: url,
+				Period: PeriodAll}
+		}
+	}
+
+	// EnqueueError was only counted overall
+	legacy[EnqErrCt] = CounterKey{Metric: EnqErrCt, Period: PeriodAll}
+	return legacy
+}
+
+// migrateCounter adds the old counter's total to k, and marks the old
+// counter as migrated in the same transaction so that it is only added
+// once.  It returns false if there was nothing to migrate.
+func migrateCounter(ctx context.Context, old string, k CounterKey) (bool,
+	error) {
+
+	// The old shards are no longer written
+	var total int64
+	q := datastore.NewQuery(shardKind).Filter("Name =", old)
+	for t := q.Run(ctx); ; {
+		var s counterShard
+		_, err := t.Next(&s)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil && !isErrFieldMismatch(err) {
+			return false, err
+		}
+		total += s.Count
+	}
+
+	name := k.Name()
+	okey := datastore.NewKey(ctx, configKind, old, 0, nil)
+	ckey := datastore.NewKey(ctx, configKind, name, 0, nil)
+	skey := datastore.NewKey(ctx, shardKind, fmt.Sprintf("%s-shard0", name),
+		0, nil)
+	migrated := false
+	opts := &datastore.TransactionOptions{XG: true}
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		migrated = false
+		var ocfg counterConfig
+		err := datastore.Get(ctx, okey, &ocfg)
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		if err != nil && !isErrFieldMismatch(err) {
+			return err
+		}
+		if ocfg.Migrated || ocfg.Metric != "" {
+			return nil
+		}
+		ocfg.Migrated = true
+		if _, err = datastore.Put(ctx, okey, &ocfg); err != nil {
+			return err
+		}
+
+		// The config lists the counter in the totals
+		var cfg counterConfig
+		err = datastore.Get(ctx, ckey, &cfg)
+		if err == datastore.ErrNoSuchEntity {
+			cfg = newCounterConfig(k)
+			_, err = datastore.Put(ctx, ckey, &cfg)
+		}
+		if err != nil && !isErrFieldMismatch(err) {
+			return err
+		}
+
+		var s counterShard
+		err = datastore.Get(ctx, skey, &s)
+		if err != nil && err != datastore.ErrNoSuchEntity &&
+			!isErrFieldMismatch(err) {
+			return err
+		}
+		s.setKey(k)
+		s.Count += total
+		if _, err = datastore.Put(ctx, skey, &s); err != nil {
+			return err
+		}
+		migrated = true
+		return nil
+	}, opts)
+	if err != nil {
+		return false, err
+	}
+	if migrated {
+		memcache.Delete(ctx, memcacheKey(name))
+	}
+	return migrated, nil
+}
+
+// migrateCounters folds the old lifetime counters for every queue and URL
+// into the new keys.  It can be run again if it times out, and does
+// nothing for counters that were already migrated.
+func migrateCounters(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	log.Debugf(ctx, "migrateCounters called")
+
+	var p Page
+	if !initPage(ctx, w, r, &p) {
+		return
+	}
+
+	// Queues that were removed from queue.yaml may still be registered
+	registry, err := getRegistry(ctx)
+	if err != nil {
+		failJSON(w, err.Error())
+		return
+	}
+	var queues []string
+	for _, qc := range registry {
+		queues = append(queues, qc.Name)
+	}
+
+	var all []AllURLs
+	if _, err = datastore.NewQuery(AllURLsKind).GetAll(ctx, &all); err != nil {
+		failJSON(w, err.Error())
+		return
+	}
+	var urls []string
+	for _, u := range all {
+		urls = append(urls, u.URL)
+	}
+
+	legacy := legacyCounterKeys(queues, urls)
+	var olds []string
+	var okeys []*datastore.Key
+	for old := range legacy {
+		olds = append(olds, old)
+		okeys = append(okeys, datastore.NewKey(ctx, configKind, old, 0, nil))
+	}
+	found, err := existing(ctx, okeys)
+	if err != nil {
+		failJSON(w, err.Error())
+		return
+	}
+
+	migrated := 0
+	for i, old := range olds {
+		if !found[i] {
+			continue
+		}
+		ok, err := migrateCounter(ctx, old, legacy[old])
+		if err != nil {
+			failJSON(w, fmt.Sprintf("Migrated %d counters, then failed on "+
+				"%s: %s", migrated, old, err.Error()))
+			return
+		}
+		if ok {
+			migrated++
+		}
+	}
+
+	log.Infof(ctx, "Migrated %d counters", migrated)
+
+	okJSON(w, migrated)
+}
@@ -0,0 +1,388 @@
+package pushq
+
+// This file has the counter queries for /counts.  Open buckets are listed
+// from CounterConfig, then closed buckets from CounterRollup, with a cursor
+// that pages across both.  The composite indexes are in index.yaml.
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// DefaultCountsLimit is the page size for counter queries
+const DefaultCountsLimit int = 500
+
+// MaxCountsLimit is the largest page size callers can ask for
+const MaxCountsLimit int = 1000
+
+// maxCountsScan limits the counters read for one page when the prefix
+// filter skips most of them.  The page is cut short and the cursor
+// continues from there.
+const maxCountsScan int = 5000
+
+// CountsFilter is the set of filters for counter queries.  Nil filters
+// match everything; a blank Queue or URL matches the overall counters.
+type CountsFilter struct {
+	Prefix string
+	Metric *string
+	Queue  *string
+	URL    *string
+	Period string
+	From   time.Time
+	To     time.Time
+	Cursor string
+	Limit  int
+}
+
+// parseCountsFilter reads the filters from the query string
+func parseCountsFilter(r *http.Request) (CountsFilter, []FieldError) {
+	var f CountsFilter
+	var fields []FieldError
+	var err error
+
+	v := r.URL.Query()
+	f.Prefix = v.Get("prefix")
+	for name, p := range map[string]**string{
+		"metric": &f.Metric,
+		"queue":  &f.Queue,
+		"url":    &f.URL,
+	} {
+		if s, ok := v[name]; ok {
+			*p = &s[0]
+		}
+	}
+	f.Period = v.Get("period")
+	f.Cursor = v.Get("cursor")
+	f.Limit = DefaultCountsLimit
+
+	switch f.Period {
+	case "", PeriodAll, PeriodHour, PeriodDay, PeriodMonth:
+	default:
+		fields = append(fields, FieldError{"period", FieldInvalid,
+			"period must be all, hour, day or month"})
+	}
+	if s := v.Get("from"); s != "" {
+		if f.From, err = parseLogTime(s); err != nil {
+			fields = append(fields, FieldError{"from", FieldInvalid,
+				"from must be formatted as " + LogTimeFormat})
+		}
+	}
+	if s := v.Get("to"); s != "" {
+		if f.To, err = parseLogTime(s); err != nil {
+			fields = append(fields, FieldError{"to", FieldInvalid,
+				"to must be formatted as " + LogTimeFormat})
+		}
+	}
+	if (!f.From.IsZero() || !f.To.IsZero()) &&
+		(f.Period == "" || f.Period == PeriodAll) {
+		fields = append(fields, FieldError{"period", FieldRequired,
+			"period must be hour, day or month to filter by date"})
+	}
+	if s := v.Get("limit"); s != "" {
+		if f.Limit, err = strconv.Atoi(s); err != nil || f.Limit < 1 ||
+			f.Limit > MaxCountsLimit {
+			fields = append(fields, FieldError{"limit", FieldInvalid,
+				"limit must be from 1 to " + strconv.Itoa(MaxCountsLimit)})
+		}
+	}
+	if f.Cursor != "" {
+		parts := strings.SplitN(f.Cursor, ":", 2)
+		valid := len(parts) == 2 &&
+			(parts[0] == configKind || parts[0] == rollupKind)
+		if valid && parts[1] != "" {
+			_, err = datastore.DecodeCursor(parts[1])
+			valid = err == nil
+		}
+		if !valid {
+			fields = append(fields, FieldError{"cursor", FieldInvalid,
+				"Invalid cursor"})
+		}
+	}
+
+	return f, fields
+}
+
+// query builds the datastore query for one kind of counter entity
+func (f *CountsFilter) query(kind string) *datastore.Query {
+	q := datastore.NewQuery(kind)
+	if f.Metric != nil {
+		q = q.Filter("Metric =", *f.Metric)
+	}
+	if f.Queue != nil {
+		q = q.Filter("Queue =", *f.Queue)
+	}
+	if f.URL != nil {
+		q = q.Filter("URL =", *f.URL)
+	}
+	if f.Period != "" {
+		q = q.Filter("Period =", f.Period)
+	}
+	if !f.From.IsZero() {
+		q = q.Filter("Bucket >=", f.From)
+	}
+	if !f.To.IsZero() {
+		q = q.Filter("Bucket <", f.To)
+	}
+	return q
+}
+
+// queryCounters returns a page of counters with their totals, and the
+// cursor for the next page, which is blank on the last page
+func queryCounters(ctx context.Context, f *CountsFilter) ([]CounterTotal,
+	string, error) {
+
+	limit := f.Limit
+	if limit <= 0 {
+		limit = DefaultCountsLimit
+	}
+
+	kind, cursor := configKind, ""
+	if f.Cursor != "" {
+		parts := strings.SplitN(f.Cursor, ":", 2)
+		kind, cursor = parts[0], parts[1]
+	}
+
+	var totals []CounterTotal
+	for {
+		page, next, err := queryCounterKind(ctx, f, kind, cursor,
+			limit-len(totals))
+		if err != nil {
+			return nil, "", err
+		}
+		totals = append(totals, page...)
+
+		if next != "" {
+			return totals, kind + ":" + next, nil
+		}
+		if kind == rollupKind {
+			return totals, "", nil
+		}
+		// Open buckets are done, go on to closed buckets
+		kind, cursor = rollupKind, ""
+		if len(totals) >= limit {
+			return totals, kind + ":", nil
+		}
+	}
+}
+
+// queryCounterKind reads up to limit counters of one kind.  It returns
+// the datastore cursor if there are more.
+func queryCounterKind(ctx context.Context, f *CountsFilter, kind string,
+	cursor string, limit int) ([]CounterTotal, string, error) {
+
+	q := f.query(kind)
+	if cursor != "" {
+		c, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		q = q.Start(c)
+	}
+
+	var keys []CounterKey
+	var shards []int
+	var counts []int64
+	scanned := 0
+	t := q.Run(ctx)
+	for len(keys) < limit && scanned < maxCountsScan {
+		var k CounterKey
+		shardCount, count := 0, int64(0)
+		var err error
+		if kind == configKind {
+			var cfg counterConfig
+			_, err = t.Next(&cfg)
+			k = CounterKey{
+				Metric: cfg.Metric,
+				Queue:  cfg.Queue,
+				URL:    cfg.URL,
+				Period: cfg.Period,
+				Bucket: cfg.Bucket.UTC(),
+			}
+			shardCount = cfg.Shards
+		} else {
+			var rollup counterShard
+			_, err = t.Next(&rollup)
+			k = rollup.key()
+			count = rollup.Count
+		}
+		if err == datastore.Done {
+			return countTotals(ctx, kind, keys, shards, counts, "")
+		}
+		if err != nil && !isErrFieldMismatch(err) {
+			return nil, "", err
+		}
+		scanned++
+
+		// Counters from before dimensions have no metric
+		if k.Metric == "" || !strings.HasPrefix(k.Name(), f.Prefix) {
+			continue
+		}
+		keys = append(keys, k)
+		shards = append(shards, shardCount)
+		counts = append(counts, count)
+	}
+
+	c, err := t.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	return countTotals(ctx, kind, keys, shards, counts, c.String())
+}
+
+// countTotals adds up the totals for a page of counters.  Open buckets
+// use the totals cached by Count, or their shards and any rollup, read
+// with GetMulti.  Rolled up buckets that have been incremented since
+// they were compacted are skipped, since they are listed with the open
+// buckets.
+func countTotals(ctx context.Context, kind string, keys []CounterKey,
+	shards []int, counts []int64, next string) ([]CounterTotal, string,
+	error) {
+
+	totals := make([]CounterTotal, len(keys))
+	for i, k := range keys {
+		totals[i] = CounterTotal{Name: k.Name(), CounterKey: k,
+			Total: counts[i]}
+	}
+
+	if kind == rollupKind {
+		var dkeys []*datastore.Key
+		for _, t := range totals {
+			dkeys = append(dkeys, datastore.NewKey(ctx, configKind,
+				t.Name, 0, nil))
+		}
+		open, err := existing(ctx, dkeys)
+		if err != nil {
+			return nil, "", err
+		}
+		var closed []CounterTotal
+		for i, t := range totals {
+			if !open[i] {
+				closed = append(closed, t)
+			}
+		}
+		return closed, next, nil
+	}
+
+	// Use the totals cached by Count
+	var mkeys []string
+	for _, t := range totals {
+		mkeys = append(mkeys, memcacheKey(t.Name))
+	}
+	cached, err := memcache.GetMulti(ctx, mkeys)
+	if err != nil {
+		cached = map[string]*memcache.Item{}
+	}
+
+	// Read the shards and rollups of the rest
+	var dkeys []*datastore.Key
+	var owners []int
+	for i, t := range totals {
+		if item, ok := cached[mkeys[i]]; ok {
+			if c, err := strconv.ParseInt(string(item.Value), 10, 64); err == nil {
+				totals[i].Total = c
+				continue
+			}
+		}
+		n := shards[i]
+		if n < 1 {
+			n = defaultShards
+		}
+		for s := 0; s < n; s++ {
+			name := fmt.Sprintf("%s-shard%d", t.Name, s)
+			dkeys = append(dkeys, datastore.NewKey(ctx, shardKind, name, 0, nil))
+			owners = append(owners, i)
+		}
+		if t.Period != PeriodAll {
+			dkeys = append(dkeys, datastore.NewKey(ctx, rollupKind, t.Name,
+				0, nil))
+			owners = append(owners, i)
+		}
+	}
+	values, err := getCounterShards(ctx, dkeys)
+	if err != nil {
+		return nil, "", err
+	}
+	read := map[int]bool{}
+	for j, v := range values {
+		totals[owners[j]].Total += v.Count
+		read[owners[j]] = true
+	}
+
+	var items []*memcache.Item
+	for i := range read {
+		items = append(items, &memcache.Item{
+			Key:        mkeys[i],
+			Object:     &totals[i].Total,
+			Expiration: 60,
+		})
+	}
+	memcache.JSON.SetMulti(ctx, items)
+
+	return totals, next, nil
+}
+
+// getBatchSize is the most keys read in one GetMulti call
+const getBatchSize int = 1000
+
+// getCounterShards reads shards or rollups in batches.  Missing entities
+// have a zero count.
+func getCounterShards(ctx context.Context, keys []*datastore.Key) (
+	[]counterShard, error) {
+
+	values := make([]counterShard, len(keys))
+	for start := 0; start < len(keys); start += getBatchSize {
+		end := start + getBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		err := datastore.GetMulti(ctx, keys[start:end], values[start:end])
+		if me, ok := err.(appengine.MultiError); ok {
+			for _, e := range me {
+				if e != nil && e != datastore.ErrNoSuchEntity &&
+					!isErrFieldMismatch(e) {
+					return nil, e
+				}
+			}
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// existing checks which of the keys have entities
+func existing(ctx context.Context, keys []*datastore.Key) ([]bool, error) {
+	found := make([]bool, len(keys))
+	for i := range found {
+		found[i] = true
+	}
+	for start := 0; start < len(keys); start += getBatchSize {
+		end := start + getBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		values := make([]datastore.PropertyList, end-start)
+		err := datastore.GetMulti(ctx, keys[start:end], values)
+		if me, ok := err.(appengine.MultiError); ok {
+			for i, e := range me {
+				if e == datastore.ErrNoSuchEntity {
+					found[start+i] = false
+				} else if e != nil {
+					return nil, e
+				}
+			}
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,201 @@
+package pushq
+
+// This file has the health checks for load balancers and uptime checks.
+// /healthz only shows that the app is serving.  /readyz checks the
+// services PushQ depends on.  It is public, so it only says which checks
+// passed, unless the caller can read /metrics; then it also has the
+// checks' errors and each queue's backlog.
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+// readyTimeout limits each readiness check
+const readyTimeout = 5 * time.Second
+
+// ReadyBacklogAge is how overdue a queue's oldest task can be before the
+// queue is reported as backlogged
+const ReadyBacklogAge = 10 * time.Minute
+
+// Queue readiness statuses.  They don't change the /readyz status code.
+const (
+	QueueOK         = "ok"
+	QueuePaused     = "paused"
+	QueueBacklogged = "backlogged"
+)
+
+// CheckResult is the result of one readiness check
+type CheckResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	MS    int64  `json:"ms"`
+}
+
+// QueueReadiness is a queue's backlog with its status
+type QueueReadiness struct {
+	QueueBacklog
+	Status string `json:"status"`
+}
+
+// ReadyResponse is the JSON returned by readyz.  Details and Queues are
+// only filled in for callers authorized by authMetrics.
+type ReadyResponse struct {
+	Ready   bool                   `json:"ready"`
+	Checks  map[string]bool        `json:"checks"`
+	Details map[string]CheckResult `json:"details,omitempty"`
+	Queues  []QueueReadiness       `json:"queues,omitempty"`
+}
+
+// healthz is the liveness check.  It doesn't call any services.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// runCheck times a readiness check
+func runCheck(ctx context.Context,
+	check func(ctx context.Context) error) CheckResult {
+
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check(ctx)
+	res := CheckResult{OK: err == nil, MS: int64(time.Since(start) /
+		time.Millisecond)}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// newReadyResponse reports which checks passed.  It is ready if all of
+// them did.
+func newReadyResponse(checks map[string]CheckResult) ReadyResponse {
+	resp := ReadyResponse{Ready: true, Checks: map[string]bool{}}
+	for name, c := range checks {
+		resp.Checks[name] = c.OK
+		if !c.OK {
+			resp.Ready = false
+		}
+	}
+	return resp
+}
+
+// queueReadiness gives each queue's backlog a status
+func queueReadiness(backlogs []QueueBacklog, paused map[string]bool,
+	now time.Time) []QueueReadiness {
+
+	queues := []QueueReadiness{}
+	for _, b := range backlogs {
+		q := QueueReadiness{QueueBacklog: b, Status: QueueOK}
+		if paused[q.Name] {
+			q.Status = QueuePaused
+		} else if b.Tasks > 0 && !b.OldestETA.IsZero() &&
+			now.Sub(b.OldestETA) > ReadyBacklogAge {
+			q.Status = QueueBacklogged
+		}
+		queues = append(queues, q)
+	}
+	return queues
+}
+
+// readyz is the readiness check.  It returns 503 if datastore, memcache
+// or taskqueue can't be reached.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	checks := map[string]CheckResult{}
+
+	// A missing entity shows that datastore answered
+	checks["datastore"] = runCheck(ctx, func(ctx context.Context) error {
+		var s QStat
+		k := datastore.NewKey(ctx, QStatKind, "readyz", 0, nil)
+		err := datastore.Get(ctx, k, &s)
+		if err == datastore.ErrNoSuchEntity || isErrFieldMismatch(err) {
+			return nil
+		}
+		return err
+	})
+
+	checks["memcache"] = runCheck(ctx, func(ctx context.Context) error {
+		_, err := memcache.Get(ctx, "readyz")
+		if err == memcache.ErrCacheMiss {
+			return nil
+		}
+		return err
+	})
+
+	var backlogs []QueueBacklog
+	checks["taskqueue"] = runCheck(ctx, func(ctx context.Context) error {
+		var err error
+		backlogs, err = getQueueBacklogs(ctx, queueNames())
+		return err
+	})
+
+	for name, c := range checks {
+		if !c.OK {
+			log.Errorf(ctx, "readyz: %s is down: %s", name, c.Error)
+		}
+	}
+
+	resp := newReadyResponse(checks)
+	allowed, detail := authMetrics(ctx, r)
+	if !detail {
+		writeReady(w, resp)
+		return
+	}
+	resp.Details = checks
+
+	// Keys limited to some queues only see those
+	names := visibleQueues(allowed)
+	visible := map[string]bool{}
+	for _, name := range names {
+		visible[name] = true
+	}
+	var shown []QueueBacklog
+	for _, b := range backlogs {
+		if visible[b.Name] {
+			shown = append(shown, b)
+		}
+	}
+
+	// Paused queues are read from QStat without creating them
+	paused := map[string]bool{}
+	if checks["datastore"].OK {
+		keys := make([]*datastore.Key, len(names))
+		for i, name := range names {
+			keys[i] = datastore.NewKey(ctx, QStatKind, name, 0, nil)
+		}
+		qstats := make([]QStat, len(names))
+		err := datastore.GetMulti(ctx, keys, qstats)
+		me, _ := err.(appengine.MultiError)
+		for i, name := range names {
+			if err == nil || (me != nil && me[i] == nil) {
+				paused[name] = !qstats[i].Active
+			}
+		}
+	}
+
+	resp.Queues = queueReadiness(shown, paused, time.Now())
+	writeReady(w, resp)
+}
+
+// writeReady writes readyz's response, with 503 if it isn't ready
+func writeReady(w http.ResponseWriter, resp ReadyResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !resp.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,273 @@
+package pushq
+
+// This file has the keyring and the envelope encryption of task payloads
+// and headers.  Each task gets its own data key, which encrypts the
+// payload and headers with AES-GCM.  The data key is encrypted (wrapped)
+// with the primary key from the keyring.  Older keys stay in the keyring
+// after a rotation so that tasks and logs encrypted with them can still
+// be read.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/user"
+)
+
+// KeyringEnv is the environment variable (set in app.yaml) that holds the
+// keyring.  It is a comma separated list of id:base64key entries, where
+// each key is 32 bytes.  The first entry is the primary key, used to
+// encrypt.  The rest are only used to decrypt.
+const KeyringEnv string = "PUSHQ_KEYRING"
+
+// DecryptAdminsEnv is the environment variable with a comma separated list
+// of admin emails that can see decrypted payloads in the admin console.
+const DecryptAdminsEnv string = "PUSHQ_DECRYPT_ADMINS"
+
+// SealedData is an encrypted payload and headers, with the wrapped data key
+type SealedData struct {
+	KeyID      string `json:"keyId"`
+	WrappedKey []byte `json:"wrappedKey"`
+	Data       []byte `json:"data"`
+}
+
+// sealedFields is what gets encrypted in SealedData.Data.
+// ResponseBody is only used for logs.
+type sealedFields struct {
+	Payload      string       `json:"payload"`
+	Headers      []TaskHeader `json:"headers"`
+	ResponseBody string       `json:"responseBody,omitempty"`
+}
+
+// Keyring holds the keys used to wrap data keys
+type Keyring struct {
+	PrimaryID string
+	Keys      map[string][]byte
+}
+
+// parseKeyring parses the keyring format described for KeyringEnv
+func parseKeyring(s string) (*Keyring, error) {
+	kr := Keyring{Keys: map[string][]byte{}}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("keyring entries must be id:base64key")
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("keyring key %s is not valid base64: %s",
+				parts[0], err.Error())
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("keyring key %s must be 32 bytes", parts[0])
+		}
+		if _, ok := kr.Keys[parts[0]]; ok {
+			return nil, fmt.Errorf("duplicate keyring key %s", parts[0])
+		}
+		if kr.PrimaryID == "" {
+			kr.PrimaryID = parts[0]
+		}
+		kr.Keys[parts[0]] = key
+	}
+	return &kr, nil
+}
+
+// getKeyring returns the configured keyring, or nil if encryption of task
+// payloads is not enabled.
+func getKeyring() (*Keyring, error) {
+	s := os.Getenv(KeyringEnv)
+	if s == "" {
+		return nil, nil
+	}
+	kr, err := parseKeyring(s)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", KeyringEnv, err.Error())
+	}
+	if kr.PrimaryID == "" {
+		return nil, nil
+	}
+	return kr, nil
+}
+
+// seal encrypts plaintext with AES-GCM.  The nonce is prepended to the
+// returned ciphertext.
+func seal(key []byte, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// unseal decrypts ciphertext created by seal
+func unseal(key []byte, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	nonce := ciphertext[:gcm.NonceSize()]
+	return gcm.Open(nil, nonce, ciphertext[gcm.NonceSize():], nil)
+}
+
+// sealFields encrypts f with a new data key, which is wrapped with the
+// primary key
+func sealFields(kr *Keyring, f *sealedFields) (*SealedData, error) {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return nil, err
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	sd := SealedData{KeyID: kr.PrimaryID}
+	if sd.Data, err = seal(dataKey, b); err != nil {
+		return nil, err
+	}
+	if sd.WrappedKey, err = seal(kr.Keys[kr.PrimaryID], dataKey); err != nil {
+		return nil, err
+	}
+	return &sd, nil
+}
+
+// unsealFields decrypts data created by sealFields
+func unsealFields(kr *Keyring, sd *SealedData) (*sealedFields, error) {
+	if kr == nil {
+		return nil, errors.New("data is encrypted but " + KeyringEnv +
+			" is not set")
+	}
+	key, ok := kr.Keys[sd.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("key %s is not in the keyring", sd.KeyID)
+	}
+	dataKey, err := unseal(key, sd.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	b, err := unseal(dataKey, sd.Data)
+	if err != nil {
+		return nil, err
+	}
+	var f sealedFields
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// sealTask encrypts the task's payload and headers into task.Sealed and
+// clears them.  Only tasks the server checked itself are sealed, so any
+// Sealed the task came with is replaced.
+func sealTask(kr *Keyring, task *Task) error {
+	sd, err := sealFields(kr, &sealedFields{
+		Payload: task.Payload,
+		Headers: task.Headers,
+	})
+	if err != nil {
+		return err
+	}
+	task.Sealed = sd
+	task.Payload = ""
+	task.Headers = nil
+	return nil
+}
+
+// unsealTask decrypts task.Sealed back into the payload and headers
+func unsealTask(kr *Keyring, task *Task) error {
+	if task.Sealed == nil {
+		return nil
+	}
+	f, err := unsealFields(kr, task.Sealed)
+	if err != nil {
+		return err
+	}
+	task.Payload = f.Payload
+	task.Headers = f.Headers
+	task.Sealed = nil
+	return nil
+}
+
+// sealLog encrypts the payload, headers and response body of a log entry
+// into Encrypted
+func sealLog(kr *Keyring, tl *TaskLog) error {
+	sd, err := sealFields(kr, &sealedFields{
+		Payload:      tl.Payload,
+		Headers:      tl.Headers,
+		ResponseBody: tl.ResponseBody,
+	})
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(sd)
+	if err != nil {
+		return err
+	}
+	tl.Encrypted = b
+	tl.Payload = ""
+	tl.Headers = nil
+	tl.ResponseBody = ""
+	return nil
+}
+
+// unsealLog decrypts a log entry's payload, headers and response body
+func unsealLog(kr *Keyring, tl *TaskLog) error {
+	if len(tl.Encrypted) == 0 {
+		return nil
+	}
+	var sd SealedData
+	if err := json.Unmarshal(tl.Encrypted, &sd); err != nil {
+		return err
+	}
+	f, err := unsealFields(kr, &sd)
+	if err != nil {
+		return err
+	}
+	tl.Payload = f.Payload
+	tl.Headers = f.Headers
+	tl.ResponseBody = f.ResponseBody
+	tl.Encrypted = nil
+	return nil
+}
+
+// canDecrypt checks that the signed in admin is allowed to see decrypted
+// payloads and headers in the admin console.
+func canDecrypt(ctx context.Context) bool {
+	u := user.Current(ctx)
+	if u == nil || !user.IsAdmin(ctx) {
+		return false
+	}
+	for _, email := range strings.Split(os.Getenv(DecryptAdminsEnv), ",") {
+		if strings.EqualFold(strings.TrimSpace(email), u.Email) {
+			return true
+		}
+	}
+	return false
+}
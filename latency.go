@@ -0,0 +1,234 @@
+package pushq
+
+// This file has the callback latency histogram.  Each callback duration is
+// counted in one bucket counter per queue and per URL, and the largest
+// duration is kept in a CounterMax entity.
+
+import (
+	"math"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+// LatencyBoundsMS are the upper bounds of the latency histogram buckets.
+// Longer durations are counted in an overflow bucket.
+var LatencyBoundsMS = []int64{
+	10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000,
+}
+
+// maxKind is the datastore Kind for the largest duration in a counter
+// bucket.  Only all time and daily maximums are kept.
+const maxKind = "CounterMax"
+
+// latencyMetric returns the counter metric for histogram bucket i
+func latencyMetric(i int) string {
+	if i >= len(LatencyBoundsMS) {
+		return LatencyCt + ".le.inf"
+	}
+	return LatencyCt + ".le." + strconv.FormatInt(LatencyBoundsMS[i], 10)
+}
+
+// latencyBucket returns the index of the histogram bucket for ms
+func latencyBucket(ms int64) int {
+	for i, bound := range LatencyBoundsMS {
+		if ms <= bound {
+			return i
+		}
+	}
+	return len(LatencyBoundsMS)
+}
+
+// callbackTimedOut reports whether a request to the URL that failed after
+// elapsed ran into its timeout
+func callbackTimedOut(err error, elapsed, timeout time.Duration) bool {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return true
+	}
+	return elapsed >= timeout
+}
+
+// callbackLatencyBucket returns the histogram bucket for a callback that
+// took ms.  Timeouts are counted in the overflow bucket, since the URL
+// would have taken longer.
+func callbackLatencyBucket(ms int64, timedOut bool) int {
+	if timedOut {
+		return len(LatencyBoundsMS)
+	}
+	return latencyBucket(ms)
+}
+
+// recordLatency counts a callback duration for the queue and the URL,
+// whether or not the callback succeeded.  The histogram counts are added
+// to the batch, and the maximums are stored now.
+func recordLatency(ctx context.Context, b *CounterBatch, queue, url string,
+	now time.Time, ms int64, timedOut bool) {
+
+	metric := latencyMetric(callbackLatencyBucket(ms, timedOut))
+	addCounters(b, metric, queue, "", now, 1)
+	addCounters(b, metric, "", url, now, 1)
+	b.Add(newCounterKey(LatencySumCt, queue, "", PeriodAll, now), ms)
+
+	for _, period := range []string{PeriodAll, PeriodDay} {
+		for _, k := range []CounterKey{
+			newCounterKey(LatencyCt, queue, "", period, now),
+			newCounterKey(LatencyCt, "", url, period, now),
+		} {
+			if err := recordMax(ctx, k, ms); err != nil {
+				log.Errorf(ctx, err.Error())
+			}
+		}
+	}
+}
+
+// recordMax stores ms as the maximum for k if it is larger than the
+// current maximum.  The maximum is cached, so most calls don't write.
+func recordMax(ctx context.Context, k CounterKey, ms int64) error {
+	name := k.Name()
+	mkey := maxKind + ":" + name
+	var cached int64
+	if _, err := memcache.JSON.Get(ctx, mkey, &cached); err == nil &&
+		cached >= ms {
+		return nil
+	}
+
+	var m counterShard
+	key := datastore.NewKey(ctx, maxKind, name, 0, nil)
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		err := datastore.Get(ctx, key, &m)
+		if err != nil && err != datastore.ErrNoSuchEntity &&
+			!isErrFieldMismatch(err) {
+			return err
+		}
+		if m.Count >= ms {
+			return nil
+		}
+		m.setKey(k)
+		m.Count = ms
+		_, err = datastore.Put(ctx, key, &m)
+		return err
+	}, nil)
+	if err != nil {
+		return err
+	}
+	memcache.JSON.Set(ctx, &memcache.Item{
+		Key:    mkey,
+		Object: &m.Count,
+	})
+	return nil
+}
+
+// getMax returns the maximum stored for k, or 0
+func getMax(ctx context.Context, k CounterKey) (int64, error) {
+	var m counterShard
+	key := datastore.NewKey(ctx, maxKind, k.Name(), 0, nil)
+	err := datastore.Get(ctx, key, &m)
+	if err != nil && err != datastore.ErrNoSuchEntity &&
+		!isErrFieldMismatch(err) {
+		return 0, err
+	}
+	return m.Count, nil
+}
+
+// LatencyStats summarizes the latency histogram for a queue or URL
+type LatencyStats struct {
+	Count int64   `json:"count"`
+	P50MS float64 `json:"p50"`
+	P90MS float64 `json:"p90"`
+	P99MS float64 `json:"p99"`
+
+	// MaxMS is 0 for hourly buckets, which don't keep a maximum
+	MaxMS int64 `json:"max"`
+}
+
+// latencyPercentile estimates the pth percentile (0 to 1) from the
+// histogram bucket counts, interpolating within the bucket.  The overflow
+// bucket runs up to maxMS if it is known.
+func latencyPercentile(counts []int64, p float64, maxMS int64) float64 {
+	var total int64
+	for _, c := range counts {
+		total += c
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := p * float64(total)
+	var before int64
+	for i, c := range counts {
+		if c == 0 || float64(before+c) < rank {
+			before += c
+			continue
+		}
+		var lower, upper float64
+		if i > 0 {
+			lower = float64(LatencyBoundsMS[i-1])
+		}
+		if i < len(LatencyBoundsMS) {
+			upper = float64(LatencyBoundsMS[i])
+		} else {
+			upper = math.Max(lower, float64(maxMS))
+		}
+		v := lower + (upper-lower)*(rank-float64(before))/float64(c)
+		if maxMS > 0 && v > float64(maxMS) {
+			v = float64(maxMS)
+		}
+		return v
+	}
+	return float64(maxMS)
+}
+
+// getLatencyStats reads the latency histogram for a queue or URL in the
+// period's bucket that holds t
+func getLatencyStats(ctx context.Context, queue, url, period string,
+	t time.Time) (LatencyStats, error) {
+
+	counts := make([]int64, len(LatencyBoundsMS)+1)
+	for i := range counts {
+		k := newCounterKey(latencyMetric(i), queue, url, period, t)
+		c, err := Count(ctx, k)
+		if err != nil {
+			return LatencyStats{}, err
+		}
+		counts[i] = c
+	}
+
+	var maxMS int64
+	if period != PeriodHour {
+		m, err := getMax(ctx, newCounterKey(LatencyCt, queue, url, period, t))
+		if err != nil {
+			return LatencyStats{}, err
+		}
+		maxMS = m
+	}
+
+	return latencyStats(counts, maxMS), nil
+}
+
+// latencyHistogram returns the histogram bucket counts from counts by
+// metric
+func latencyHistogram(counts map[string]int64) []int64 {
+	hist := make([]int64, len(LatencyBoundsMS)+1)
+	for i := range hist {
+		hist[i] = counts[latencyMetric(i)]
+	}
+	return hist
+}
+
+// latencyStats summarizes the histogram bucket counts
+func latencyStats(counts []int64, maxMS int64) LatencyStats {
+	stats := LatencyStats{MaxMS: maxMS}
+	for _, c := range counts {
+		stats.Count += c
+	}
+	stats.P50MS = latencyPercentile(counts, 0.5, maxMS)
+	stats.P90MS = latencyPercentile(counts, 0.9, maxMS)
+	stats.P99MS = latencyPercentile(counts, 0.99, maxMS)
+	return stats
+}
@@ -0,0 +1,199 @@
+package pushq
+
+// This file has the TaskLog queries shared by the logs pages.
+// The composite indexes they need are in index.yaml.
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// LogTypes are the values of TaskLog.LogType
+var LogTypes = []string{
+	"Enqueue",
+	"EnqueueError",
+	"CallbackSuccess",
+	"CallbackError",
+	"ClientError",
+	"NewRequestError",
+	"CallbackPaused",
+	"SecretError",
+}
+
+// DefaultLogLimit is the page size for log queries
+const DefaultLogLimit int = 100
+
+// MaxLogLimit is the largest page size callers can ask for
+const MaxLogLimit int = 500
+
+// LogTimeFormat is the format of the from and to filters, which is what
+// an HTML datetime-local input sends.  RFC 3339 is also accepted.
+const LogTimeFormat string = "2006-01-02T15:04"
+
+// LogFilter is the set of filters for TaskLog queries.  Blank and zero
+// values match everything.
+type LogFilter struct {
+	QueueName string
+	LogType   string
+	URL       string
+	Code      int
+	RequestID string
+	From      time.Time
+	To        time.Time
+	Cursor    string
+	Limit     int
+}
+
+// parseLogTime parses a from or to filter value as UTC
+func parseLogTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Parse(LogTimeFormat, s)
+}
+
+// parseLogFilter reads the filters from the query string.  The queue name
+// is not read here, since it is part of the path on the admin pages.
+func parseLogFilter(r *http.Request) (LogFilter, []FieldError) {
+	var f LogFilter
+	var fields []FieldError
+	var err error
+
+	v := r.URL.Query()
+	f.LogType = v.Get("type")
+	f.URL = v.Get("url")
+	f.RequestID = v.Get("requestId")
+	f.Cursor = v.Get("cursor")
+	f.Limit = DefaultLogLimit
+
+	if s := v.Get("code"); s != "" {
+		if f.Code, err = strconv.Atoi(s); err != nil {
+			fields = append(fields, FieldError{"code", FieldInvalid,
+				"code must be a number"})
+		}
+	}
+	if s := v.Get("from"); s != "" {
+		if f.From, err = parseLogTime(s); err != nil {
+			fields = append(fields, FieldError{"from", FieldInvalid,
+				"from must be formatted as " + LogTimeFormat})
+		}
+	}
+	if s := v.Get("to"); s != "" {
+		if f.To, err = parseLogTime(s); err != nil {
+			fields = append(fields, FieldError{"to", FieldInvalid,
+				"to must be formatted as " + LogTimeFormat})
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		if f.Limit, err = strconv.Atoi(s); err != nil || f.Limit < 1 ||
+			f.Limit > MaxLogLimit {
+			fields = append(fields, FieldError{"limit", FieldInvalid,
+				"limit must be from 1 to " + strconv.Itoa(MaxLogLimit)})
+		}
+	}
+	if f.Cursor != "" {
+		if _, err = datastore.DecodeCursor(f.Cursor); err != nil {
+			fields = append(fields, FieldError{"cursor", FieldInvalid,
+				"cursor must be the cursor from the last page"})
+		}
+	}
+
+	return f, fields
+}
+
+// Values converts the filter back to query string values, without the
+// cursor or limit
+func (f *LogFilter) Values() url.Values {
+	v := url.Values{}
+	if f.LogType != "" {
+		v.Set("type", f.LogType)
+	}
+	if f.URL != "" {
+		v.Set("url", f.URL)
+	}
+	if f.Code != 0 {
+		v.Set("code", strconv.Itoa(f.Code))
+	}
+	if f.RequestID != "" {
+		v.Set("requestId", f.RequestID)
+	}
+	if !f.From.IsZero() {
+		v.Set("from", f.From.Format(LogTimeFormat))
+	}
+	if !f.To.IsZero() {
+		v.Set("to", f.To.Format(LogTimeFormat))
+	}
+	return v
+}
+
+// queryLogs runs a TaskLog query for one page of logs, newest first.
+// It returns the logs, their keys and the cursor for the next page,
+// which is blank on the last page.
+func queryLogs(ctx context.Context, f *LogFilter) ([]TaskLog,
+	[]*datastore.Key, string, error) {
+
+	q := datastore.NewQuery(TaskLogKind)
+	if f.QueueName != "" {
+		q = q.Filter("q =", f.QueueName)
+	}
+	if f.LogType != "" {
+		q = q.Filter("lty =", f.LogType)
+	}
+	if f.URL != "" {
+		q = q.Filter("u =", f.URL)
+	}
+	if f.Code != 0 {
+		q = q.Filter("cd =", f.Code)
+	}
+	if f.RequestID != "" {
+		q = q.Filter("rid =", f.RequestID)
+	}
+	if !f.From.IsZero() {
+		q = q.Filter("utc >=", f.From)
+	}
+	if !f.To.IsZero() {
+		q = q.Filter("utc <", f.To)
+	}
+	q = q.Order("-utc")
+
+	if f.Cursor != "" {
+		c, err := datastore.DecodeCursor(f.Cursor)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		q = q.Start(c)
+	}
+
+	limit := f.Limit
+	if limit <= 0 {
+		limit = DefaultLogLimit
+	}
+
+	var logs []TaskLog
+	var keys []*datastore.Key
+	t := q.Run(ctx)
+	for len(logs) < limit {
+		var tl TaskLog
+		k, err := t.Next(&tl)
+		if err == datastore.Done {
+			return logs, keys, "", nil
+		}
+		if err != nil && !isErrFieldMismatch(err) {
+			return nil, nil, "", err
+		}
+		logs = append(logs, tl)
+		keys = append(keys, k)
+	}
+
+	c, err := t.Cursor()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return logs, keys, c.String(), nil
+}
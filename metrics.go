@@ -0,0 +1,217 @@
+package pushq
+
+// This file has the /metrics endpoint, which exposes the counters in the
+// Prometheus text format.  See
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+// MetricsTokenEnv is the environment variable with the bearer token
+// Prometheus can use to scrape /metrics
+const MetricsTokenEnv string = "PUSHQ_METRICS_TOKEN"
+
+// ScopeMetrics lets an API Key scrape /metrics
+const ScopeMetrics string = "metrics"
+
+// authMetrics checks for the scrape token or an API Key with the metrics
+// scope.  It returns the queues the caller can see, or nil for all.
+func authMetrics(ctx context.Context, r *http.Request) ([]string, bool) {
+	token := os.Getenv(MetricsTokenEnv)
+	if token != "" {
+		bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1 {
+			return nil, true
+		}
+	}
+
+	apiKey, ok := authKey(ctx, r)
+	if !ok || !apiKey.HasScope(ScopeMetrics) {
+		return nil, false
+	}
+	return apiKey.Queues, true
+}
+
+// escapeLabel escapes a Prometheus label value
+func escapeLabel(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, `"`, `\"`, -1)
+	return strings.Replace(v, "\n", `\n`, -1)
+}
+
+// metricWriter writes metrics in the text format
+type metricWriter struct {
+	buf bytes.Buffer
+}
+
+// family writes the HELP and TYPE lines for a metric
+func (m *metricWriter) family(name, typ, help string) {
+	fmt.Fprintf(&m.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes one value.  labels are name, value pairs.
+func (m *metricWriter) sample(name string, value float64, labels ...string) {
+	m.buf.WriteString(name)
+	if len(labels) > 0 {
+		m.buf.WriteString("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				m.buf.WriteString(",")
+			}
+			fmt.Fprintf(&m.buf, `%s="%s"`, labels[i], escapeLabel(labels[i+1]))
+		}
+		m.buf.WriteString("}")
+	}
+	m.buf.WriteString(" ")
+	m.buf.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	m.buf.WriteString("\n")
+}
+
+// queueCounters are the all time counters exposed for each queue
+var queueCounters = []struct {
+	metric string
+	name   string
+	help   string
+}{
+	{EnqCt, "pushq_enqueued_total", "Tasks enqueued."},
+	{AvgTotalCt, "pushq_callback_success_total",
+		"Callbacks that returned 200."},
+	{ErrCt, "pushq_callback_errors_total",
+		"Callbacks that did not return 200."},
+}
+
+// metrics writes the counters for Prometheus
+func metrics(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	log.Debugf(ctx, "metrics called")
+
+	queues, ok := authMetrics(ctx, r)
+	if !ok {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	var names []string
+	for _, def := range QueueDefs {
+		if len(queues) == 0 {
+			names = append(names, def.Name)
+			continue
+		}
+		for _, q := range queues {
+			if q == def.Name {
+				names = append(names, def.Name)
+			}
+		}
+	}
+
+	now := time.Now().UTC()
+	count := func(metric, queue string) float64 {
+		c, err := Count(ctx, newCounterKey(metric, queue, "", PeriodAll, now))
+		if err != nil {
+			log.Errorf(ctx, err.Error())
+		}
+		return float64(c)
+	}
+
+	var m metricWriter
+
+	for _, c := range queueCounters {
+		m.family(c.name, "counter", c.help)
+		for _, name := range names {
+			m.sample(c.name, count(c.metric, name), "queue", name)
+		}
+	}
+	if len(queues) == 0 {
+		m.family("pushq_enqueue_errors_total", "counter",
+			"Tasks that could not be added to a queue.")
+		m.sample("pushq_enqueue_errors_total", count(EnqErrCt, ""))
+	}
+
+	// The histogram buckets are cumulative
+	const hist = "pushq_callback_duration_seconds"
+	m.family(hist, "histogram", "Duration of callbacks.")
+	for _, name := range names {
+		var total float64
+		for i := range LatencyBoundsMS {
+			total += count(latencyMetric(i), name)
+			le := strconv.FormatFloat(float64(LatencyBoundsMS[i])/1000,
+				'g', -1, 64)
+			m.sample(hist+"_bucket", total, "queue", name, "le", le)
+		}
+		total += count(latencyMetric(len(LatencyBoundsMS)), name)
+		m.sample(hist+"_bucket", total, "queue", name, "le", "+Inf")
+		m.sample(hist+"_sum", count(LatencySumCt, name)/1000, "queue", name)
+		m.sample(hist+"_count", total, "queue", name)
+	}
+
+	// Throttles are the queue.yaml token buckets, and the rate App Engine
+	// is enforcing now
+	m.family("pushq_queue_rate", "gauge",
+		"Tasks per second allowed by the queue.yaml rate.")
+	for _, name := range names {
+		def, _ := getQueueDef(name)
+		rate, _ := parseQueueRate(def.Rate)
+		m.sample("pushq_queue_rate", rate, "queue", name)
+	}
+	m.family("pushq_queue_bucket_size", "gauge",
+		"Tasks that can run at once before the rate applies.")
+	for _, name := range names {
+		def, _ := getQueueDef(name)
+		size := def.BucketSize
+		if size == 0 {
+			size = DefaultBucketSize
+		}
+		m.sample("pushq_queue_bucket_size", float64(size), "queue", name)
+	}
+	if backlogs, err := getQueueBacklogs(ctx, names); err != nil {
+		log.Errorf(ctx, "Unable to get queue stats: %s", err.Error())
+	} else {
+		m.family("pushq_queue_enforced_rate", "gauge",
+			"Tasks per second App Engine is running the queue at.")
+		for _, b := range backlogs {
+			m.sample("pushq_queue_enforced_rate", b.EnforcedRate, "queue",
+				b.Name)
+		}
+	}
+
+	m.family("pushq_queue_paused", "gauge",
+		"1 if callbacks for the queue are paused.")
+	var reject []float64
+	for _, name := range names {
+		var s QStat
+		if err := getOrCreateQStat(ctx, &s, name); err != nil {
+			log.Errorf(ctx, err.Error())
+		}
+		p, rj := 0.0, 0.0
+		if !s.Active {
+			p = 1
+			if s.RejectWhilePaused {
+				rj = 1
+			}
+		}
+		reject = append(reject, rj)
+		m.sample("pushq_queue_paused", p, "queue", name)
+	}
+	m.family("pushq_queue_rejecting", "gauge",
+		"1 if enq rejects new tasks for the paused queue.")
+	for i, name := range names {
+		m.sample("pushq_queue_rejecting", reject[i], "queue", name)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(m.buf.Bytes())
+}
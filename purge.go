@@ -0,0 +1,310 @@
+package pushq
+
+// This file has the admin action that purges a queue, and the audit log
+// of purges.  A purge can't be undone, so the console makes the admin
+// type the queue's name, and the entry records who purged what.
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/gorilla/mux"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+)
+
+// AuditKind is the datastore Kind for the admin audit log
+const AuditKind string = "AuditLog"
+
+// AuditPurgeQueue is the AuditEntry.Action for purges
+const AuditPurgeQueue = "purgeQueue"
+
+// Snapshot limits.  Push queues can't be listed, so the snapshot is the
+// tasks logged as enqueued that haven't logged a success.  The snapshot is
+// saved in the audit entry, so it is kept under the 1 MB entity limit.
+const (
+	snapshotMaxTasks     = 1000
+	snapshotMaxSuccesses = 5000
+	snapshotMaxBytes     = 900 << 10
+)
+
+// purgeUnfinished is the Error of an audit entry until the purge returns
+const purgeUnfinished = "The purge did not finish"
+
+// AuditEntry is a model for admin actions that change or lose data
+type AuditEntry struct {
+	ID     int64     `datastore:"-" json:"id"`
+	Action string    `json:"action"`
+	Queue  string    `json:"queue"`
+	User   string    `json:"user"`
+	UTC    time.Time `json:"utc"`
+
+	// Error is blank if the action worked
+	Error string `datastore:",noindex" json:"error,omitempty"`
+
+	// Tasks and OldestETA are the queue's backlog before the action
+	Tasks     int       `datastore:",noindex" json:"tasks"`
+	OldestETA time.Time `datastore:",noindex" json:"oldestETA"`
+
+	// HasSnapshot is set when a purge asked for a snapshot.  Snapshot is
+	// the JSON []PendingTask, and SnapshotTasks is its length.
+	// SnapshotDropped is the number of the oldest tasks left out to fit.
+	HasSnapshot     bool   `datastore:",noindex" json:"hasSnapshot"`
+	SnapshotTasks   int    `datastore:",noindex" json:"snapshotTasks"`
+	SnapshotDropped int    `datastore:",noindex" json:"snapshotDropped"`
+	Snapshot        []byte `datastore:",noindex" json:"-"`
+}
+
+// PendingTask is the metadata of a task in a purge snapshot.  Payloads
+// and headers are left out, since they may be secret.
+type PendingTask struct {
+	TaskName    string    `json:"taskName"`
+	URL         string    `json:"url"`
+	RequestID   string    `json:"requestId,omitempty"`
+	EnqueuedUTC time.Time `json:"enqueuedUTC"`
+}
+
+// PurgeRequest is the body of purgeQueue.  Confirm must be the queue's
+// name, typed by the admin.
+type PurgeRequest struct {
+	Name     string
+	Confirm  string
+	Snapshot bool
+}
+
+// snapshotPending finds the tasks in a queue's logs that were enqueued but
+// haven't succeeded, newest first.  It needs logging on for the queue, and
+// also includes tasks that ran out of retries.
+func snapshotPending(ctx context.Context, queue string) ([]PendingTask,
+	error) {
+
+	var enqs []TaskLog
+	q := datastore.NewQuery(TaskLogKind).
+		Filter("q =", queue).
+		Filter("lty =", "Enqueue").
+		Order("-utc").
+		Limit(snapshotMaxTasks)
+	_, err := q.GetAll(ctx, &enqs)
+	if err != nil && !isErrFieldMismatch(err) {
+		return nil, err
+	}
+	if len(enqs) == 0 {
+		return []PendingTask{}, nil
+	}
+
+	done := map[string]bool{}
+	from := enqs[len(enqs)-1].UTC
+	q = datastore.NewQuery(TaskLogKind).
+		Filter("q =", queue).
+		Filter("lty =", "CallbackSuccess").
+		Filter("utc >=", from).
+		Order("-utc").
+		Limit(snapshotMaxSuccesses)
+	for t := q.Run(ctx); ; {
+		var l TaskLog
+		_, err := t.Next(&l)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil && !isErrFieldMismatch(err) {
+			return nil, err
+		}
+		done[l.TaskName] = true
+	}
+
+	pending := []PendingTask{}
+	for _, l := range enqs {
+		if l.TaskName == "" || done[l.TaskName] {
+			continue
+		}
+		pending = append(pending, PendingTask{
+			TaskName:    l.TaskName,
+			URL:         l.URL,
+			RequestID:   l.RequestID,
+			EnqueuedUTC: l.UTC,
+		})
+	}
+	return pending, nil
+}
+
+// encodeSnapshot returns the JSON of the newest pending tasks that fit in
+// maxBytes, and how many of them that is.  pending is newest first.
+func encodeSnapshot(pending []PendingTask, maxBytes int) ([]byte, int,
+	error) {
+
+	n := len(pending)
+	for {
+		b, err := json.Marshal(pending[:n])
+		if err != nil || len(b) <= maxBytes || n == 0 {
+			return b, n, err
+		}
+
+		// Cut in proportion to the excess, at least one task at a time
+		cut := n - n*maxBytes/len(b)
+		if cut < 1 {
+			cut = 1
+		}
+		n -= cut
+	}
+}
+
+// getAuditEntries returns the newest audit entries for a queue
+func getAuditEntries(ctx context.Context, queue string,
+	limit int) ([]AuditEntry, error) {
+
+	var entries []AuditEntry
+	q := datastore.NewQuery(AuditKind).
+		Filter("Queue =", queue).
+		Order("-UTC").
+		Limit(limit)
+	keys, err := q.GetAll(ctx, &entries)
+	if err != nil && !isErrFieldMismatch(err) {
+		return nil, err
+	}
+	for i, k := range keys {
+		entries[i].ID = k.IntID()
+	}
+	return entries, nil
+}
+
+// purgeQueue deletes every task in a queue with taskqueue.Purge.  The
+// audit entry, with the backlog and optionally a snapshot, is saved first,
+// and the queue isn't purged if it can't be.
+func purgeQueue(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	log.Debugf(ctx, "purgeQueue called")
+
+	var p Page
+	if !initPage(ctx, w, r, &p) {
+		return
+	}
+
+	// Decode the POST body
+	decoder := json.NewDecoder(r.Body)
+	var req PurgeRequest
+	err := decoder.Decode(&req)
+	if err != nil {
+		failJSON(w, err.Error())
+		return
+	}
+
+	if _, ok := getQueueDef(req.Name); !ok {
+		failJSON(w, "Invalid QueueName")
+		return
+	}
+	if req.Confirm != req.Name {
+		failJSON(w, "Type the queue name to confirm the purge")
+		return
+	}
+
+	entry := AuditEntry{
+		Action: AuditPurgeQueue,
+		Queue:  req.Name,
+		User:   p.Name,
+		UTC:    time.Now().UTC(),
+	}
+
+	backlogs, err := getQueueBacklogs(ctx, []string{req.Name})
+	if err != nil {
+		log.Errorf(ctx, "Unable to get queue stats: %s", err.Error())
+	} else {
+		entry.Tasks = backlogs[0].Tasks
+		entry.OldestETA = backlogs[0].OldestETA
+	}
+
+	// Don't purge if the snapshot that was asked for can't be saved
+	if req.Snapshot {
+		pending, err := snapshotPending(ctx, req.Name)
+		if err != nil {
+			failJSON(w, "Unable to snapshot tasks: "+err.Error())
+			return
+		}
+		var kept int
+		entry.Snapshot, kept, err = encodeSnapshot(pending, snapshotMaxBytes)
+		if err != nil {
+			failJSON(w, err.Error())
+			return
+		}
+		entry.SnapshotTasks = kept
+		entry.SnapshotDropped = len(pending) - kept
+		entry.HasSnapshot = true
+	}
+
+	// The entry is saved before the purge, so that no purge goes
+	// unrecorded, and then updated with the result
+	entry.Error = purgeUnfinished
+	k := datastore.NewIncompleteKey(ctx, AuditKind, nil)
+	k, err = datastore.Put(ctx, k, &entry)
+	if err != nil {
+		failJSON(w, "Unable to save the audit entry: "+err.Error())
+		return
+	}
+	entry.ID = k.IntID()
+
+	purgeErr := taskqueue.Purge(ctx, req.Name)
+	entry.Error = ""
+	if purgeErr != nil {
+		entry.Error = purgeErr.Error()
+	}
+	if _, err = datastore.Put(ctx, k, &entry); err != nil {
+		log.Errorf(ctx, "Unable to update audit entry %d for purge of %s by "+
+			"%s: %s", entry.ID, req.Name, p.Name, err.Error())
+	}
+
+	if purgeErr != nil {
+		failJSON(w, purgeErr.Error())
+		return
+	}
+
+	log.Infof(ctx, "Queue %s purged by %s with %d tasks", req.Name, p.Name,
+		entry.Tasks)
+
+	okJSON(w, entry)
+}
+
+// auditSnapshot emits the snapshot of an audit entry as JSON
+func auditSnapshot(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	log.Debugf(ctx, "auditSnapshot called")
+
+	var p Page
+	if !initPage(ctx, w, r, &p) {
+		return
+	}
+
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		failJSON(w, "Invalid id")
+		return
+	}
+
+	var entry AuditEntry
+	k := datastore.NewKey(ctx, AuditKind, "", id, nil)
+	err = datastore.Get(ctx, k, &entry)
+	if err != nil && !isErrFieldMismatch(err) {
+		failJSON(w, err.Error())
+		return
+	}
+	if !entry.HasSnapshot {
+		failJSON(w, "No snapshot")
+		return
+	}
+
+	var pending []PendingTask
+	err = json.Unmarshal(entry.Snapshot, &pending)
+	if err != nil {
+		failJSON(w, err.Error())
+		return
+	}
+
+	okJSON(w, pending)
+}
@@ -0,0 +1,214 @@
+package pushq
+
+// This file has queue backlogs from taskqueue.QueueStats, for the admin
+// console and /queues/stats.  A cron job samples them into hourly and
+// daily counters, so that averages can be charted with /counts/series.
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+)
+
+// Backlog sample metrics.  Each sample adds to the counters for its
+// queue, so the average of a metric over a bucket is its count divided
+// by the BacklogSamples count.
+const (
+	// BacklogSamplesCt counts the samples
+	BacklogSamplesCt = "BacklogSamples"
+
+	// BacklogTasksCt adds up the tasks in the queue
+	BacklogTasksCt = "BacklogTasks"
+
+	// BacklogInFlightCt adds up the tasks being run
+	BacklogInFlightCt = "BacklogInFlight"
+
+	// BacklogExecutedCt adds up the tasks run in the minute before each
+	// sample.  With one sample a minute, it is the number of tasks run.
+	BacklogExecutedCt = "BacklogExecuted"
+
+	// BacklogAgeCt adds up the seconds the oldest task was overdue
+	BacklogAgeCt = "BacklogAgeSeconds"
+
+	// BacklogRateCt adds up the enforced rate in thousandths of a task
+	// per second
+	BacklogRateCt = "BacklogRateMilli"
+)
+
+// backlogPeriods are the periods backlog samples are counted in.  Sums of
+// samples over all time wouldn't mean anything.
+var backlogPeriods = []string{PeriodDay, PeriodHour}
+
+// QueueBacklog is a queue's backlog from taskqueue.QueueStats
+type QueueBacklog struct {
+	Name            string    `json:"name"`
+	Tasks           int       `json:"tasks"`
+	OldestETA       time.Time `json:"oldestETA"`
+	Executed1Minute int       `json:"executed1Minute"`
+	InFlight        int       `json:"inFlight"`
+	EnforcedRate    float64   `json:"enforcedRate"`
+}
+
+// getQueueBacklogs reads the backlogs of the named queues
+func getQueueBacklogs(ctx context.Context, names []string) ([]QueueBacklog,
+	error) {
+
+	if len(names) == 0 {
+		return nil, nil
+	}
+	stats, err := taskqueue.QueueStats(ctx, names)
+	if err != nil {
+		return nil, err
+	}
+	backlogs := make([]QueueBacklog, len(stats))
+	for i, st := range stats {
+		backlogs[i] = QueueBacklog{
+			Name:            names[i],
+			Tasks:           st.Tasks,
+			OldestETA:       st.OldestETA,
+			Executed1Minute: st.Executed1Minute,
+			InFlight:        st.InFlight,
+			EnforcedRate:    st.EnforcedRate,
+		}
+	}
+	return backlogs, nil
+}
+
+// queueNames returns the names of the queues in queue.yaml
+func queueNames() []string {
+	var names []string
+	for _, def := range QueueDefs {
+		names = append(names, def.Name)
+	}
+	return names
+}
+
+// visibleQueues returns the queues in queue.yaml that are in allowed, or
+// all of them if allowed is empty.  Queues that were removed from
+// queue.yaml are left out.
+func visibleQueues(allowed []string) []string {
+	names := queueNames()
+	if len(allowed) == 0 {
+		return names
+	}
+	var visible []string
+	for _, name := range names {
+		for _, q := range allowed {
+			if q == name {
+				visible = append(visible, name)
+				break
+			}
+		}
+	}
+	return visible
+}
+
+// QueueStatsResponse is the JSON returned by getQueueStats
+type QueueStatsResponse struct {
+	Queues []QueueBacklog `json:"queues"`
+}
+
+// getQueueStats returns the backlog of each queue, or of the queue in the
+// queue parameter
+func getQueueStats(w http.ResponseWriter, r *http.Request) {
+
+	ctx := appengine.NewContext(r)
+
+	apiKey, ok := authKey(ctx, r)
+	if !ok {
+		apiError(w, http.StatusUnauthorized, ErrCodeUnauthorized,
+			"Not authorized")
+		return
+	}
+
+	queue := r.URL.Query().Get("queue")
+	var fields []FieldError
+	if queue != "" {
+		if _, ok := getQueueDef(queue); !ok {
+			fields = append(fields, FieldError{"queue", FieldInvalid,
+				"Invalid QueueName"})
+		}
+	}
+
+	if queue != "" && !checkCounterQuery(w, apiKey, queue, fields) {
+		return
+	}
+
+	// Keys limited to some queues only see those that are still in
+	// queue.yaml
+	names := visibleQueues(apiKey.Queues)
+	if queue != "" {
+		names = []string{queue}
+	}
+
+	backlogs, err := getQueueBacklogs(ctx, names)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal,
+			err.Error())
+		return
+	}
+
+	resp := QueueStatsResponse{Queues: backlogs}
+	if resp.Queues == nil {
+		resp.Queues = []QueueBacklog{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(w)
+	enc.Encode(resp)
+}
+
+// addBacklogSample adds a backlog sample to the batch
+func addBacklogSample(b *CounterBatch, q QueueBacklog, now time.Time) {
+	var age int64
+	if q.Tasks > 0 && !q.OldestETA.IsZero() && now.After(q.OldestETA) {
+		age = int64(now.Sub(q.OldestETA) / time.Second)
+	}
+	for _, period := range backlogPeriods {
+		add := func(metric string, by int64) {
+			b.Add(newCounterKey(metric, q.Name, "", period, now), by)
+		}
+		add(BacklogSamplesCt, 1)
+		add(BacklogTasksCt, int64(q.Tasks))
+		add(BacklogInFlightCt, int64(q.InFlight))
+		add(BacklogExecutedCt, int64(q.Executed1Minute))
+		add(BacklogAgeCt, age)
+		add(BacklogRateCt, int64(q.EnforcedRate*1000))
+	}
+}
+
+// sampleQueueStats is called by cron.  It samples the backlog of each
+// queue into counters.
+func sampleQueueStats(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	log.Debugf(ctx, "sampleQueueStats called")
+
+	if !isCronRequest(ctx, r) {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	backlogs, err := getQueueBacklogs(ctx, queueNames())
+	if err != nil {
+		log.Errorf(ctx, "Unable to get queue stats: %s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().UTC()
+	var b CounterBatch
+	for _, q := range backlogs {
+		addBacklogSample(&b, q, now)
+	}
+	commitCounters(ctx, &b, now)
+
+	log.Infof(ctx, "Sampled %d queues", len(backlogs))
+}
@@ -0,0 +1,126 @@
+package pushq
+
+// This file has the redaction rules that saveLog applies to task logs.
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// RedactedValue replaces masked header values and payload fields in logs
+const RedactedValue string = "[REDACTED]"
+
+// RedactRules is the per-queue config for what gets masked in TaskLog
+type RedactRules struct {
+	// Headers are header names to mask, case insensitive
+	Headers []string `datastore:",noindex"`
+
+	// Paths are dotted paths to mask in JSON payloads, e.g. customer.email.
+	// A * matches any key or array element, e.g. items.*.ssn
+	Paths []string `datastore:",noindex"`
+
+	// MaxPayloadBytes truncates logged payloads.  Zero means no limit.
+	MaxPayloadBytes int `datastore:",noindex"`
+}
+
+// redactTask masks a copy of the task according to the rules.  It returns
+// a description of each thing that was redacted.
+func redactTask(task *Task, rules *RedactRules) []string {
+	var redacted []string
+
+	// Copy the headers so the caller's task isn't changed
+	if len(rules.Headers) > 0 && len(task.Headers) > 0 {
+		headers := make([]TaskHeader, len(task.Headers))
+		copy(headers, task.Headers)
+		for i, h := range headers {
+			for _, name := range rules.Headers {
+				if strings.EqualFold(h.Name, name) {
+					headers[i].Value = RedactedValue
+					redacted = append(redacted, "header "+h.Name)
+					break
+				}
+			}
+		}
+		task.Headers = headers
+	}
+
+	if len(rules.Paths) > 0 && task.Payload != "" {
+		var doc interface{}
+		if err := json.Unmarshal([]byte(task.Payload), &doc); err == nil {
+			var paths []string
+			for _, path := range rules.Paths {
+				if redactPath(doc, strings.Split(path, ".")) {
+					paths = append(paths, path)
+				}
+			}
+			if len(paths) > 0 {
+				if b, err := json.Marshal(doc); err == nil {
+					task.Payload = string(b)
+					for _, path := range paths {
+						redacted = append(redacted, "payload "+path)
+					}
+				}
+			}
+		}
+	}
+
+	if rules.MaxPayloadBytes > 0 && len(task.Payload) > rules.MaxPayloadBytes {
+		task.Payload = truncateUTF8(task.Payload, rules.MaxPayloadBytes)
+		redacted = append(redacted, "payload truncated")
+	}
+
+	return redacted
+}
+
+// truncateUTF8 cuts s to at most n bytes, backing off so that a multi-byte
+// rune isn't split
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// redactPath masks the value at path in a decoded JSON document.
+// Returns true if anything was masked.
+func redactPath(doc interface{}, path []string) bool {
+	if len(path) == 0 {
+		return false
+	}
+	key := path[0]
+	last := len(path) == 1
+	found := false
+
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if key != "*" && k != key {
+				continue
+			}
+			if last {
+				v[k] = RedactedValue
+				found = true
+			} else if redactPath(child, path[1:]) {
+				found = true
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			if key != "*" && key != strconv.Itoa(i) {
+				continue
+			}
+			if last {
+				v[i] = RedactedValue
+				found = true
+			} else if redactPath(child, path[1:]) {
+				found = true
+			}
+		}
+	}
+	return found
+}
@@ -0,0 +1,527 @@
+package pushq
+
+// This file has the queue registry.  The list of queues comes from
+// queue.yaml, which is read at startup, and per-queue config is stored
+// in datastore.  The admin console flags drift between the two.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/taskqueue"
+)
+
+// QueueYAMLFile is the queue config deployed with the app
+const QueueYAMLFile string = "queue.yaml"
+
+// QueueConfigKind is the name of the datastore table for the queue registry
+const QueueConfigKind string = "QueueConfig"
+
+// QueueDef is a queue as declared in queue.yaml
+type QueueDef struct {
+	Name       string
+	Rate       string
+	RetryLimit int
+	AgeLimit   string
+
+	// BucketSize is the token bucket size, or 0 if queue.yaml leaves it
+	// to App Engine's default of 5
+	BucketSize int
+}
+
+// DefaultBucketSize is App Engine's bucket_size for push queues that
+// don't set one
+const DefaultBucketSize int = 5
+
+// parseQueueRate converts a queue.yaml rate, e.g. 10/s or 100/m, to tasks
+// per second
+func parseQueueRate(rate string) (float64, error) {
+	parts := strings.SplitN(rate, "/", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid rate %q", rate)
+	}
+	n, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q", rate)
+	}
+	switch parts[1] {
+	case "s":
+		return n, nil
+	case "m":
+		return n / 60, nil
+	case "h":
+		return n / 3600, nil
+	case "d":
+		return n / 86400, nil
+	}
+	return 0, fmt.Errorf("invalid rate %q", rate)
+}
+
+// DefaultTimeoutSeconds is the callback timeout used when neither the task
+// nor its queue sets one.  A zero timeout would otherwise mean no timeout.
+const DefaultTimeoutSeconds int = 30
+
+// MaxTaskBytes is App Engine's limit on the size of a task
+const MaxTaskBytes int = 1 << 20
+
+// DefaultMaxPayloadBytes is the payload limit for queues that don't set
+// one, and the most a queue can set.  The queued task also holds the
+// headers and the rest of the task, and sealing makes it bigger, so it
+// leaves room under MaxTaskBytes.
+const DefaultMaxPayloadBytes int = MaxTaskBytes / 2
+
+// RetryPolicy is the retry config for tasks.  Zero values leave the
+// setting to queue.yaml.
+type RetryPolicy struct {
+	RetryLimit        int32   `datastore:",noindex" json:"retryLimit"`
+	AgeLimitSeconds   int     `datastore:",noindex" json:"ageLimitSeconds"`
+	MinBackoffSeconds float64 `datastore:",noindex" json:"minBackoffSeconds"`
+	MaxBackoffSeconds float64 `datastore:",noindex" json:"maxBackoffSeconds"`
+	MaxDoublings      int32   `datastore:",noindex" json:"maxDoublings"`
+}
+
+// IsZero is true if the policy doesn't change any settings
+func (rp *RetryPolicy) IsZero() bool {
+	return *rp == RetryPolicy{}
+}
+
+// RetryOptions converts the policy for use with taskqueue.Add
+func (rp *RetryPolicy) RetryOptions() *taskqueue.RetryOptions {
+	ro := taskqueue.RetryOptions{}
+	ro.RetryLimit = rp.RetryLimit
+	ro.AgeLimit = time.Duration(rp.AgeLimitSeconds) * time.Second
+	ro.MinBackoff = time.Duration(rp.MinBackoffSeconds * float64(time.Second))
+	ro.MaxBackoff = time.Duration(rp.MaxBackoffSeconds * float64(time.Second))
+	ro.MaxDoublings = rp.MaxDoublings
+	return &ro
+}
+
+// QueueConfig is the registry entry for a queue.  Rate, RetryLimit and
+// AgeLimit are copied from queue.yaml when the queue is registered, so
+// that changes to the deployed file show up as drift.  The rest is
+// registry-only config that enq applies to tasks for the queue.
+type QueueConfig struct {
+	Name        string
+	Description string `datastore:",noindex"`
+	Rate        string `datastore:",noindex"`
+	RetryLimit  int    `datastore:",noindex"`
+	AgeLimit    string `datastore:",noindex"`
+	UpdatedOn   time.Time
+
+	// Defaults for tasks that don't set these
+	DefaultTimeoutSeconds int          `datastore:",noindex"`
+	DefaultHeaders        []TaskHeader `datastore:",noindex"`
+	DefaultRetry          RetryPolicy
+
+	// Limits.  Zero or empty means no limit, except that payloads are
+	// limited to DefaultMaxPayloadBytes.
+	MaxTimeoutSeconds  int      `datastore:",noindex"`
+	MaxPayloadBytes    int      `datastore:",noindex"`
+	AllowedURLPrefixes []string `datastore:",noindex"`
+
+	// Redact is applied to tasks before they are logged
+	Redact RedactRules
+
+	// LogRetentionDays is how long logs are kept.  Zero means the default.
+	LogRetentionDays int `datastore:",noindex"`
+
+	// Drift describes differences from queue.yaml.  It is not stored.
+	Drift []string `datastore:"-"`
+}
+
+// QueueDefs is the list of queues from queue.yaml, in file order
+var QueueDefs []QueueDef
+
+// loadQueueYAML reads queue.yaml and validates it.  It is called from init,
+// so the app won't start with a queue.yaml it can't understand.
+func loadQueueYAML(filename string) ([]QueueDef, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	defs, err := parseQueueYAML(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err.Error())
+	}
+	return defs, nil
+}
+
+// parseQueueYAML parses the subset of the queue.yaml format that we use:
+// a list of queues with a name, a rate, an optional bucket_size and
+// optional retry_parameters.
+// Other settings are ignored.
+func parseQueueYAML(b []byte) ([]QueueDef, error) {
+	var defs []QueueDef
+	var def *QueueDef
+	seen := map[string]bool{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		// Top level keys other than queue (e.g. total_storage_limit)
+		// are not part of a queue
+		trimmed := strings.TrimSpace(line)
+		if line[0] != ' ' && line[0] != '-' {
+			def = nil
+			continue
+		}
+
+		newQueue := strings.HasPrefix(trimmed, "- ")
+		if newQueue {
+			trimmed = strings.TrimSpace(trimmed[2:])
+		}
+
+		parts := strings.SplitN(trimmed, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: expected key: value", lineNum)
+		}
+		k := strings.TrimSpace(parts[0])
+		v := strings.Trim(strings.TrimSpace(parts[1]), `"'`)
+
+		if newQueue {
+			defs = append(defs, QueueDef{})
+			def = &defs[len(defs)-1]
+		}
+		if def == nil {
+			return nil, fmt.Errorf("line %d: %s outside of a queue", lineNum, k)
+		}
+
+		switch k {
+		case "name":
+			if v == "" {
+				return nil, fmt.Errorf("line %d: empty queue name", lineNum)
+			}
+			if seen[v] {
+				return nil, fmt.Errorf("line %d: duplicate queue %s", lineNum, v)
+			}
+			seen[v] = true
+			def.Name = v
+		case "rate":
+			if _, err := parseQueueRate(v); err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineNum, err.Error())
+			}
+			def.Rate = v
+		case "bucket_size":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("line %d: invalid bucket_size", lineNum)
+			}
+			def.BucketSize = n
+		case "task_retry_limit":
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid task_retry_limit", lineNum)
+			}
+			def.RetryLimit = n
+		case "task_age_limit":
+			def.AgeLimit = v
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, d := range defs {
+		if d.Name == "" {
+			return nil, fmt.Errorf("queue %d has no name", i+1)
+		}
+	}
+	if !seen["default"] {
+		return nil, fmt.Errorf("the default queue must be declared")
+	}
+
+	return defs, nil
+}
+
+// getQueueDef returns the queue.yaml entry for a queue
+func getQueueDef(name string) (QueueDef, bool) {
+	for _, d := range QueueDefs {
+		if d.Name == name {
+			return d, true
+		}
+	}
+	return QueueDef{}, false
+}
+
+// newQueueConfig creates a registry entry from a queue.yaml entry
+func newQueueConfig(def QueueDef) QueueConfig {
+	return QueueConfig{
+		Name:       def.Name,
+		Rate:       def.Rate,
+		RetryLimit: def.RetryLimit,
+		AgeLimit:   def.AgeLimit,
+		UpdatedOn:  time.Now().UTC(),
+	}
+}
+
+// getOrCreateQueueConfig loads the registry entry for a queue.  Queues that
+// are declared in queue.yaml are registered the first time they are used.
+// Returns datastore.ErrNoSuchEntity for queues that aren't in either place.
+func getOrCreateQueueConfig(ctx context.Context, qc *QueueConfig,
+	name string) error {
+
+	key := datastore.NewKey(ctx, QueueConfigKind, name, 0, nil)
+	err := datastore.Get(ctx, key, qc)
+	if err == nil || isErrFieldMismatch(err) {
+		qc.Drift = queueDrift(qc)
+		return nil
+	}
+	if err != datastore.ErrNoSuchEntity {
+		return err
+	}
+
+	def, ok := getQueueDef(name)
+	if !ok {
+		return datastore.ErrNoSuchEntity
+	}
+	*qc = newQueueConfig(def)
+	if _, err := datastore.Put(ctx, key, qc); err != nil {
+		return err
+	}
+	return nil
+}
+
+// isValidQueue checks that a queue is deployed and registered, and loads
+// its config.
+func isValidQueue(ctx context.Context, qc *QueueConfig, name string) (bool, error) {
+	if _, ok := getQueueDef(name); !ok {
+		return false, nil
+	}
+	if err := getOrCreateQueueConfig(ctx, qc, name); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// queueDrift compares a registry entry to queue.yaml
+func queueDrift(qc *QueueConfig) []string {
+	var drift []string
+	def, ok := getQueueDef(qc.Name)
+	if !ok {
+		return append(drift, "Not in "+QueueYAMLFile)
+	}
+	if def.Rate != qc.Rate {
+		drift = append(drift, fmt.Sprintf("Rate is %s in %s, registered as %s",
+			def.Rate, QueueYAMLFile, qc.Rate))
+	}
+	if def.RetryLimit != qc.RetryLimit {
+		drift = append(drift, fmt.Sprintf(
+			"Retry limit is %d in %s, registered as %d",
+			def.RetryLimit, QueueYAMLFile, qc.RetryLimit))
+	}
+	if def.AgeLimit != qc.AgeLimit {
+		drift = append(drift, fmt.Sprintf(
+			"Age limit is %s in %s, registered as %s",
+			def.AgeLimit, QueueYAMLFile, qc.AgeLimit))
+	}
+	return drift
+}
+
+// getRegistry returns every queue in the registry or in queue.yaml, sorted
+// by name, with drift filled in.  Queues in queue.yaml that have not been
+// registered yet are included with a drift entry but are not saved.
+func getRegistry(ctx context.Context) ([]QueueConfig, error) {
+	var configs []QueueConfig
+	q := datastore.NewQuery(QueueConfigKind)
+	if _, err := q.GetAll(ctx, &configs); err != nil && !isErrFieldMismatch(err) {
+		return nil, err
+	}
+
+	registered := map[string]bool{}
+	for i := range configs {
+		registered[configs[i].Name] = true
+		configs[i].Drift = queueDrift(&configs[i])
+	}
+
+	for _, def := range QueueDefs {
+		if !registered[def.Name] {
+			qc := newQueueConfig(def)
+			qc.UpdatedOn = time.Time{}
+			qc.Drift = []string{"Not registered"}
+			configs = append(configs, qc)
+		}
+	}
+
+	sort.Slice(configs, func(i, j int) bool {
+		return configs[i].Name < configs[j].Name
+	})
+
+	return configs, nil
+}
+
+// syncRegistry registers every queue in queue.yaml and copies the queue.yaml
+// settings into existing entries, which clears drift for deployed queues.
+// Descriptions and other registry-only config are kept.
+func syncRegistry(ctx context.Context) error {
+	for _, def := range QueueDefs {
+		var qc QueueConfig
+		key := datastore.NewKey(ctx, QueueConfigKind, def.Name, 0, nil)
+		err := datastore.Get(ctx, key, &qc)
+		if err != nil && err != datastore.ErrNoSuchEntity &&
+			!isErrFieldMismatch(err) {
+			return err
+		}
+		qc.Name = def.Name
+		qc.Rate = def.Rate
+		qc.RetryLimit = def.RetryLimit
+		qc.AgeLimit = def.AgeLimit
+		qc.UpdatedOn = time.Now().UTC()
+		if _, err := datastore.Put(ctx, key, &qc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validatePolicy checks that a queue's defaults are within its own limits
+func validatePolicy(qc *QueueConfig) error {
+	if qc.DefaultTimeoutSeconds < 0 || qc.MaxTimeoutSeconds < 0 ||
+		qc.MaxPayloadBytes < 0 {
+		return fmt.Errorf("Timeouts and sizes can't be negative")
+	}
+	if qc.MaxPayloadBytes > DefaultMaxPayloadBytes {
+		return fmt.Errorf("Max payload bytes can't be more than %d",
+			DefaultMaxPayloadBytes)
+	}
+	if qc.MaxTimeoutSeconds > 0 &&
+		qc.DefaultTimeoutSeconds > qc.MaxTimeoutSeconds {
+		return fmt.Errorf("Default timeout is more than the max timeout")
+	}
+	for _, h := range qc.DefaultHeaders {
+		if h.Name == "" {
+			return fmt.Errorf("Default headers must have a name")
+		}
+	}
+	if qc.LogRetentionDays < 0 {
+		return fmt.Errorf("Log retention days can't be negative")
+	}
+	if qc.Redact.MaxPayloadBytes < 0 {
+		return fmt.Errorf("Max logged payload bytes can't be negative")
+	}
+	for _, prefix := range qc.AllowedURLPrefixes {
+		if !isCallbackURL(prefix) {
+			return fmt.Errorf("Allowed URL prefixes must be absolute http or "+
+				"https URLs: %s", prefix)
+		}
+	}
+	for _, path := range qc.Redact.Paths {
+		for _, part := range strings.Split(path, ".") {
+			if part == "" {
+				return fmt.Errorf("Invalid redaction path: %s", path)
+			}
+		}
+	}
+	return nil
+}
+
+// urlHasPrefix reports whether rawurl is under prefix.  The scheme and
+// host must be the same, and the path must match up to a "/", so that
+// https://api.example.com doesn't allow https://api.example.com.evil.net.
+func urlHasPrefix(rawurl, prefix string) bool {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return false
+	}
+	p, err := url.Parse(prefix)
+	if err != nil || p.Host == "" {
+		return false
+	}
+	if u.Scheme != p.Scheme || !strings.EqualFold(u.Host, p.Host) ||
+		u.User != nil {
+		return false
+	}
+	dir := strings.TrimSuffix(p.Path, "/")
+	return dir == "" || u.Path == dir || strings.HasPrefix(u.Path, dir+"/")
+}
+
+// applyQueuePolicy fills in the queue's defaults for anything the task
+// didn't set, then checks the task against the queue's limits.
+func applyQueuePolicy(task *Task, qc *QueueConfig) []FieldError {
+	var fields []FieldError
+
+	// Timeout
+	if task.TimeoutSeconds == 0 {
+		task.TimeoutSeconds = qc.DefaultTimeoutSeconds
+	}
+	if task.TimeoutSeconds == 0 {
+		task.TimeoutSeconds = DefaultTimeoutSeconds
+		if qc.MaxTimeoutSeconds > 0 && task.TimeoutSeconds > qc.MaxTimeoutSeconds {
+			task.TimeoutSeconds = qc.MaxTimeoutSeconds
+		}
+	}
+	if qc.MaxTimeoutSeconds > 0 && task.TimeoutSeconds > qc.MaxTimeoutSeconds {
+		fields = append(fields, FieldError{"timeoutSeconds", FieldTooLarge,
+			fmt.Sprintf("timeoutSeconds is more than the max of %d for %s",
+				qc.MaxTimeoutSeconds, qc.Name)})
+	}
+
+	// Headers set on the task win over the queue's defaults
+	for _, dh := range qc.DefaultHeaders {
+		found := false
+		for _, h := range task.Headers {
+			if strings.EqualFold(h.Name, dh.Name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			task.Headers = append(task.Headers, dh)
+		}
+	}
+
+	// Retries
+	if task.Retry == nil && !qc.DefaultRetry.IsZero() {
+		rp := qc.DefaultRetry
+		task.Retry = &rp
+	}
+
+	// URL
+	if len(qc.AllowedURLPrefixes) > 0 {
+		allowed := false
+		for _, prefix := range qc.AllowedURLPrefixes {
+			if urlHasPrefix(task.URL, prefix) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			fields = append(fields, FieldError{"url", FieldNotAllowed,
+				fmt.Sprintf("url is not allowed for %s", qc.Name)})
+		}
+	}
+
+	// Payload
+	maxPayload := qc.MaxPayloadBytes
+	if maxPayload == 0 {
+		maxPayload = DefaultMaxPayloadBytes
+	}
+	if len(task.Payload) > maxPayload {
+		fields = append(fields, FieldError{"payload", FieldTooLarge,
+			fmt.Sprintf("payload is more than the max of %d bytes for %s",
+				maxPayload, qc.Name)})
+	}
+
+	return fields
+}
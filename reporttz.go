@@ -0,0 +1,230 @@
+package pushq
+
+// This file has the reporting timezone.  Counter buckets are always UTC,
+// so "today" in another timezone is added up from the hourly buckets
+// since local midnight.
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// ReportTimezoneEnv is the environment variable with the IANA name of the
+// timezone for "today" on the admin console and /counts/today, e.g.
+// America/New_York.  The default is UTC.
+const ReportTimezoneEnv string = "PUSHQ_REPORT_TIMEZONE"
+
+// ReportLocation is the reporting timezone, set from PUSHQ_REPORT_TIMEZONE
+var ReportLocation = time.UTC
+
+// initReportLocation loads the reporting timezone
+func initReportLocation() error {
+	loc, err := time.LoadLocation(os.Getenv(ReportTimezoneEnv))
+	if err != nil {
+		return err
+	}
+	ReportLocation = loc
+	return nil
+}
+
+// loadTimezone returns the named timezone, or the reporting timezone if
+// name is blank
+func loadTimezone(name string) (*time.Location, error) {
+	if name == "" {
+		return ReportLocation, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// todayStart returns the start of the hourly bucket that holds midnight
+// in loc on the day that holds now.  In timezones with offsets that aren't
+// whole hours, today starts up to 45 minutes early.
+func todayStart(loc *time.Location, now time.Time) time.Time {
+	local := now.In(loc)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0,
+		0, loc)
+	return bucketStart(PeriodHour, midnight)
+}
+
+// TodayStats are the counts for a queue or URL since midnight in a
+// timezone.  Blank Queue and URL are the overall counts.
+type TodayStats struct {
+	Queue    string    `json:"queue,omitempty"`
+	URL      string    `json:"url,omitempty"`
+	Timezone string    `json:"timezone"`
+	From     time.Time `json:"from"`
+
+	// Counts are by metric, without the latency histogram buckets
+	Counts map[string]int64 `json:"counts"`
+
+	// Latency.MaxMS is the largest of the UTC days that overlap today,
+	// since maximums aren't kept by hour
+	Latency LatencyStats `json:"latency"`
+}
+
+// getTodayStats adds up the hourly buckets for a queue or URL from the
+// start of today in loc up to now.  The hours are cached, see
+// hourlyCounts.
+func getTodayStats(ctx context.Context, queue, url string,
+	loc *time.Location, now time.Time) (TodayStats, error) {
+
+	stats := TodayStats{
+		Queue:    queue,
+		URL:      url,
+		Timezone: loc.String(),
+		From:     todayStart(loc, now),
+		Counts:   map[string]int64{},
+	}
+
+	counts, err := hourlyCounts(ctx, queue, url, stats.From, now)
+	if err != nil {
+		return stats, err
+	}
+	for metric, c := range counts {
+		if !strings.HasPrefix(metric, LatencyCt) {
+			stats.Counts[metric] = c
+		}
+	}
+
+	var maxMS int64
+	for d := bucketStart(PeriodDay, stats.From); !d.After(now); d = d.AddDate(0, 0, 1) {
+		m, err := getMax(ctx, newCounterKey(LatencyCt, queue, url, PeriodDay,
+			d))
+		if err != nil {
+			return stats, err
+		}
+		if m > maxMS {
+			maxMS = m
+		}
+	}
+	stats.Latency = latencyStats(latencyHistogram(counts), maxMS)
+	return stats, nil
+}
+
+// Hourly totals are cached in memcache by queue, URL and hour.  An hour
+// is settled once write-behind deltas for it can no longer be flushed,
+// and its totals are kept for a day.  Newer hours are cached as long as
+// Count caches a total.
+const (
+	hourCountsSettled = time.Hour + deltaExpiry
+	hourCountsExpiry  = 24 * time.Hour
+	hourCountsRecent  = time.Minute
+)
+
+// hourCountsKey is the memcache key for the totals of an hour bucket
+func hourCountsKey(queue, url string, bucket time.Time) string {
+	return fmt.Sprintf("HourCounts:%d:%s", bucket.Unix(),
+		hashName(queue+"|"+url))
+}
+
+// hourCountsTTL is how long the totals of an hour bucket are cached at now
+func hourCountsTTL(bucket, now time.Time) time.Duration {
+	if now.Sub(bucket) >= hourCountsSettled {
+		return hourCountsExpiry
+	}
+	return hourCountsRecent
+}
+
+// hourlyCounts adds up the hourly buckets for a queue or URL that start
+// from from up to now, by metric.  Cached hours are only read from
+// datastore if an hour before them isn't cached.
+func hourlyCounts(ctx context.Context, queue, url string,
+	from, now time.Time) (map[string]int64, error) {
+
+	var buckets []time.Time
+	var mkeys []string
+	for b := bucketStart(PeriodHour, from); !b.After(now); {
+		buckets = append(buckets, b)
+		mkeys = append(mkeys, hourCountsKey(queue, url, b))
+		b = b.Add(time.Hour)
+	}
+
+	// A cache error reads every hour from datastore
+	cached, _ := memcache.GetMulti(ctx, mkeys)
+	hours := map[time.Time]map[string]int64{}
+	var first time.Time
+	for i, b := range buckets {
+		var c map[string]int64
+		item, ok := cached[mkeys[i]]
+		if !ok || json.Unmarshal(item.Value, &c) != nil {
+			first = b
+			break
+		}
+		hours[b] = c
+	}
+
+	if !first.IsZero() {
+		read, err := readHourlyCounts(ctx, queue, url, first)
+		if err != nil {
+			return nil, err
+		}
+		var items []*memcache.Item
+		for i, b := range buckets {
+			if b.Before(first) {
+				continue
+			}
+			hours[b] = read[b]
+			if hours[b] == nil {
+				hours[b] = map[string]int64{}
+			}
+			value, err := json.Marshal(hours[b])
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, &memcache.Item{
+				Key:        mkeys[i],
+				Value:      value,
+				Expiration: hourCountsTTL(b, now),
+			})
+		}
+		memcache.SetMulti(ctx, items)
+	}
+
+	counts := map[string]int64{}
+	for _, c := range hours {
+		for metric, n := range c {
+			counts[metric] += n
+		}
+	}
+	return counts, nil
+}
+
+// readHourlyCounts reads the hourly buckets for a queue or URL that start
+// from from, by bucket and metric
+func readHourlyCounts(ctx context.Context, queue, url string,
+	from time.Time) (map[time.Time]map[string]int64, error) {
+
+	// Open buckets are in shards, and closed buckets are rolled up
+	hours := map[time.Time]map[string]int64{}
+	for _, kind := range []string{shardKind, rollupKind} {
+		q := datastore.NewQuery(kind).
+			Filter("Queue =", queue).
+			Filter("URL =", url).
+			Filter("Period =", PeriodHour).
+			Filter("Bucket >=", from)
+		for t := q.Run(ctx); ; {
+			var s counterShard
+			_, err := t.Next(&s)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil && !isErrFieldMismatch(err) {
+				return nil, err
+			}
+			b := s.Bucket.UTC()
+			if hours[b] == nil {
+				hours[b] = map[string]int64{}
+			}
+			hours[b][s.Metric] += s.Count
+		}
+	}
+	return hours, nil
+}
@@ -0,0 +1,226 @@
+package pushq
+
+// This file has the cron job that deletes task logs older than each
+// queue's retention period.
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// DefaultLogRetentionDays is used for queues that don't set a retention
+const DefaultLogRetentionDays int = 30
+
+// purgeBatchSize is the number of logs deleted at a time
+const purgeBatchSize int = 500
+
+// purgeTimeLimit stops the purge before the cron request deadline.
+// Anything left is deleted on the next run.
+const purgeTimeLimit = 8 * time.Minute
+
+// logRetentionDays returns the number of days logs are kept for a queue
+func logRetentionDays(qc *QueueConfig) int {
+	if qc.LogRetentionDays > 0 {
+		return qc.LogRetentionDays
+	}
+	return DefaultLogRetentionDays
+}
+
+// purgeQueueLogs deletes the logs for a queue that were written before
+// cutoff.  It returns the number deleted and whether it finished.
+func purgeQueueLogs(ctx context.Context, name string, cutoff time.Time,
+	deadline time.Time) (int, bool, error) {
+
+	deleted := 0
+	var cursor *datastore.Cursor
+	for time.Now().Before(deadline) {
+		q := datastore.NewQuery(TaskLogKind).KeysOnly().
+			Filter("q =", name).
+			Filter("utc <", cutoff).
+			Limit(purgeBatchSize)
+		if cursor != nil {
+			q = q.Start(*cursor)
+		}
+
+		var keys []*datastore.Key
+		t := q.Run(ctx)
+		for {
+			k, err := t.Next(nil)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				return deleted, false, err
+			}
+			keys = append(keys, k)
+		}
+		if len(keys) == 0 {
+			return deleted, true, nil
+		}
+
+		if err := datastore.DeleteMulti(ctx, keys); err != nil {
+			return deleted, false, err
+		}
+		deleted += len(keys)
+
+		c, err := t.Cursor()
+		if err != nil {
+			return deleted, false, err
+		}
+		cursor = &c
+	}
+	return deleted, false, nil
+}
+
+// logCountPeriods are the periods saved logs are counted in
+var logCountPeriods = []string{PeriodDay, PeriodHour}
+
+// countLog adds a log saved at t to the batch
+func countLog(b *CounterBatch, queue string, t time.Time) {
+	for _, period := range logCountPeriods {
+		b.Add(newCounterKey(LogsCt, queue, "", period, t), 1)
+	}
+}
+
+// storedLogCount estimates the logs stored for a queue from the logs
+// counted since cutoff, since older ones are purged.  The hour that holds
+// cutoff and the rest of its day are added up by hour, and later days by
+// day.
+func storedLogCount(ctx context.Context, queue string, cutoff,
+	now time.Time) (int64, error) {
+
+	day := nextBucket(PeriodDay, bucketStart(PeriodDay, cutoff))
+	hours, err := CountSeries(ctx, newCounterKey(LogsCt, queue, "",
+		PeriodHour, cutoff), cutoff, day)
+	if err != nil {
+		return 0, err
+	}
+	days, err := CountSeries(ctx, newCounterKey(LogsCt, queue, "",
+		PeriodDay, day), day, now)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	for _, p := range append(hours, days...) {
+		n += p.Count
+	}
+	return n, nil
+}
+
+// logQueues returns the queues to purge logs for.  These are the registry
+// and any other queues that have logs, which keep the default retention.
+func logQueues(ctx context.Context) ([]QueueConfig, error) {
+	registry, err := getRegistry(ctx)
+	if err != nil {
+		return nil, err
+	}
+	registered := map[string]bool{}
+	for _, qc := range registry {
+		registered[qc.Name] = true
+	}
+
+	var names []TaskLog
+	q := datastore.NewQuery(TaskLogKind).Project("q").Distinct()
+	if _, err = q.GetAll(ctx, &names); err != nil &&
+		!isErrFieldMismatch(err) {
+		return nil, err
+	}
+	for _, l := range names {
+		if l.QueueName != "" && !registered[l.QueueName] {
+			registry = append(registry, QueueConfig{Name: l.QueueName})
+		}
+	}
+	return registry, nil
+}
+
+// purgeLogs is called by cron.  It deletes expired logs for each queue,
+// starting with the queues visited longest ago so that a queue with a lot
+// to delete doesn't hold up the others, and stores the number of logs left
+// for the admin console.
+func purgeLogs(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	log.Debugf(ctx, "purgeLogs called")
+
+	if !isCronRequest(ctx, r) {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	configs, err := logQueues(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	stats := make([]QStat, len(configs))
+	for i := range configs {
+		if err = getOrCreateQStat(ctx, &stats[i], configs[i].Name); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	order := make([]int, len(configs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return stats[order[i]].LogsCountedOn.Before(
+			stats[order[j]].LogsCountedOn)
+	})
+
+	now := time.Now().UTC()
+	deadline := now.Add(purgeTimeLimit)
+	for _, i := range order {
+		qc := &configs[i]
+		days := logRetentionDays(qc)
+		cutoff := now.AddDate(0, 0, -days)
+
+		deleted, done, err := purgeQueueLogs(ctx, qc.Name, cutoff, deadline)
+		if err != nil {
+			log.Errorf(ctx, "Unable to purge logs for %s: %s",
+				qc.Name, err.Error())
+			continue
+		}
+		log.Infof(ctx, "Purged %d logs older than %d days for %s",
+			deleted, days, qc.Name)
+
+		n, err := storedLogCount(ctx, qc.Name, cutoff, now)
+		if err != nil {
+			log.Errorf(ctx, "Unable to count logs for %s: %s",
+				qc.Name, err.Error())
+			continue
+		}
+
+		// Save only the log count, without the stats in the loaded copy
+		key := datastore.NewKey(ctx, QStatKind, qc.Name, 0, nil)
+		err = datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+			var s QStat
+			if err := datastore.Get(ctx, key, &s); err != nil &&
+				!isErrFieldMismatch(err) {
+				return err
+			}
+			s.LogCount = n
+			s.LogsCountedOn = time.Now().UTC()
+			_, err := datastore.Put(ctx, key, &s)
+			return err
+		}, nil)
+		if err != nil {
+			log.Errorf(ctx, err.Error())
+		}
+
+		if !done {
+			log.Infof(ctx, "Stopped purging at %s, will continue next run",
+				qc.Name)
+			break
+		}
+	}
+}
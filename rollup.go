@@ -0,0 +1,251 @@
+package pushq
+
+// This file has the cron job that compacts counters.  The shards of closed
+// hour and day buckets are collapsed into one CounterRollup entity per
+// bucket, and old day buckets are rolled into month buckets.
+
+import (
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// CounterRollupDays is how long hour and day buckets are kept.  After
+// that, day buckets are added to month buckets and hour buckets are
+// deleted, since the day and month buckets have the same counts.
+const CounterRollupDays int = 90
+
+// compactGrace is how long after a bucket ends before it is compacted,
+// to leave time for increments that were in progress when it ended
+const compactGrace = time.Hour
+
+// compactBatchSize is the number of counters read at a time
+const compactBatchSize int = 100
+
+// compactTimeLimit stops compaction before the cron request deadline.
+// Anything left is compacted on the next run.
+const compactTimeLimit = 8 * time.Minute
+
+// addToRollup moves count into the rollup for k, and deletes the entity
+// it came from, in one transaction, so each count is added exactly once.
+// from is read again in the transaction, and skipped if it is gone.
+func addToRollup(ctx context.Context, k CounterKey,
+	from *datastore.Key) error {
+
+	rkey := datastore.NewKey(ctx, rollupKind, k.Name(), 0, nil)
+	opts := &datastore.TransactionOptions{XG: true}
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var s counterShard
+		err := datastore.Get(ctx, from, &s)
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		if err != nil && !isErrFieldMismatch(err) {
+			return err
+		}
+
+		var rollup counterShard
+		err = datastore.Get(ctx, rkey, &rollup)
+		if err != nil && err != datastore.ErrNoSuchEntity &&
+			!isErrFieldMismatch(err) {
+			return err
+		}
+		rollup.setKey(k)
+		rollup.Count += s.Count
+		if _, err = datastore.Put(ctx, rkey, &rollup); err != nil {
+			return err
+		}
+		return datastore.Delete(ctx, from)
+	}, opts)
+}
+
+// collapseCounter moves the shards of a closed bucket into its rollup,
+// then deletes the counter's config
+func collapseCounter(ctx context.Context, k CounterKey) error {
+	name := k.Name()
+	q := datastore.NewQuery(shardKind).KeysOnly().Filter("Name =", name)
+	keys, err := q.GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err = addToRollup(ctx, k, key); err != nil {
+			return err
+		}
+	}
+	ckey := datastore.NewKey(ctx, configKind, name, 0, nil)
+	return datastore.Delete(ctx, ckey)
+}
+
+// collapseClosedBuckets collapses the counters of a period whose buckets
+// started before cutoff.  It returns the number collapsed and whether it
+// finished.
+func collapseClosedBuckets(ctx context.Context, period string,
+	cutoff time.Time, deadline time.Time) (int, bool, error) {
+
+	collapsed := 0
+	for time.Now().Before(deadline) {
+		// Collapsed configs are deleted, so each batch starts over
+		q := datastore.NewQuery(configKind).
+			Filter("Period =", period).
+			Filter("Bucket <", cutoff).
+			Limit(compactBatchSize)
+		var configs []counterConfig
+		if _, err := q.GetAll(ctx, &configs); err != nil &&
+			!isErrFieldMismatch(err) {
+			return collapsed, false, err
+		}
+		if len(configs) == 0 {
+			return collapsed, true, nil
+		}
+		for _, cfg := range configs {
+			k := CounterKey{
+				Metric: cfg.Metric,
+				Queue:  cfg.Queue,
+				URL:    cfg.URL,
+				Period: cfg.Period,
+				Bucket: cfg.Bucket.UTC(),
+			}
+			if err := collapseCounter(ctx, k); err != nil {
+				return collapsed, false, err
+			}
+			collapsed++
+		}
+	}
+	return collapsed, false, nil
+}
+
+// rollUpDays adds day rollups that started before cutoff to their month
+// rollups.  It returns the number rolled up and whether it finished.
+func rollUpDays(ctx context.Context, cutoff time.Time,
+	deadline time.Time) (int, bool, error) {
+
+	rolled := 0
+	for time.Now().Before(deadline) {
+		q := datastore.NewQuery(rollupKind).
+			Filter("Period =", PeriodDay).
+			Filter("Bucket <", cutoff).
+			Limit(compactBatchSize)
+		var days []counterShard
+		keys, err := q.GetAll(ctx, &days)
+		if err != nil && !isErrFieldMismatch(err) {
+			return rolled, false, err
+		}
+		if len(keys) == 0 {
+			return rolled, true, nil
+		}
+		for i, day := range days {
+			k := day.key()
+			k.Period = PeriodMonth
+			k.Bucket = bucketStart(PeriodMonth, k.Bucket)
+			if err = addToRollup(ctx, k, keys[i]); err != nil {
+				return rolled, false, err
+			}
+			rolled++
+		}
+	}
+	return rolled, false, nil
+}
+
+// deleteBuckets deletes entities of the kind for the period's buckets
+// that started before cutoff.  It returns the number deleted and whether
+// it finished.
+func deleteBuckets(ctx context.Context, kind string, period string,
+	cutoff time.Time, deadline time.Time) (int, bool, error) {
+
+	deleted := 0
+	for time.Now().Before(deadline) {
+		q := datastore.NewQuery(kind).KeysOnly().
+			Filter("Period =", period).
+			Filter("Bucket <", cutoff).
+			Limit(purgeBatchSize)
+		keys, err := q.GetAll(ctx, nil)
+		if err != nil {
+			return deleted, false, err
+		}
+		if len(keys) == 0 {
+			return deleted, true, nil
+		}
+		if err = datastore.DeleteMulti(ctx, keys); err != nil {
+			return deleted, false, err
+		}
+		deleted += len(keys)
+	}
+	return deleted, false, nil
+}
+
+// compactCounters is called by cron.  It collapses the shards of closed
+// buckets, then rolls up or deletes buckets older than CounterRollupDays.
+func compactCounters(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	log.Debugf(ctx, "compactCounters called")
+
+	if !isCronRequest(ctx, r) {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	now := time.Now().UTC()
+	deadline := now.Add(compactTimeLimit)
+
+	// A bucket is closed when it ended more than compactGrace ago,
+	// so it started before the bucket that holds now - compactGrace.
+	for _, period := range []string{PeriodHour, PeriodDay} {
+		cutoff := bucketStart(period, now.Add(-compactGrace))
+
+		n, done, err := collapseClosedBuckets(ctx, period, cutoff, deadline)
+		if err != nil {
+			log.Errorf(ctx, "Unable to collapse %s counters: %s",
+				period, err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof(ctx, "Collapsed %d %s counters", n, period)
+		if !done {
+			log.Infof(ctx, "Stopped compacting, will continue next run")
+			return
+		}
+	}
+
+	cutoff := bucketStart(PeriodDay, now.AddDate(0, 0, -CounterRollupDays))
+
+	n, done, err := rollUpDays(ctx, cutoff, deadline)
+	if err != nil {
+		log.Errorf(ctx, "Unable to roll up day counters: %s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof(ctx, "Rolled %d day counters into months", n)
+	if !done {
+		log.Infof(ctx, "Stopped compacting, will continue next run")
+		return
+	}
+
+	n, done, err = deleteBuckets(ctx, rollupKind, PeriodHour, cutoff,
+		deadline)
+	if err != nil {
+		log.Errorf(ctx, "Unable to delete hour counters: %s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof(ctx, "Deleted %d hour counters", n)
+	if !done {
+		log.Infof(ctx, "Stopped compacting, will continue next run")
+		return
+	}
+
+	// Daily maximums aren't rolled up
+	n, _, err = deleteBuckets(ctx, maxKind, PeriodDay, cutoff, deadline)
+	if err != nil {
+		log.Errorf(ctx, "Unable to delete day maximums: %s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof(ctx, "Deleted %d day maximums", n)
+}
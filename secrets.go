@@ -0,0 +1,200 @@
+package pushq
+
+// This file has the secrets store.  Admins save named secrets, which are
+// encrypted at rest, and tasks refer to them in header values with a
+// {{secret:name}} placeholder.  Placeholders are only resolved by callback
+// when it builds the outbound request, so task payloads and logs never
+// contain the secret values.  Each secret lists the URLs it can be sent
+// to, so that a task can't send it to a host of its own.
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+)
+
+// SecretKind is the name of the datastore table for secrets
+const SecretKind string = "Secret"
+
+// SecretsKeyEnv is the environment variable (set in app.yaml) that holds
+// the base64 encoded 256 bit AES key used to encrypt secrets
+const SecretsKeyEnv string = "PUSHQ_SECRETS_KEY"
+
+// Secret is a named value that can be injected into callback headers.
+// Only the encrypted value is stored.
+type Secret struct {
+	Name       string
+	Value      string `datastore:"-"`
+	Ciphertext []byte `datastore:",noindex" json:"-"`
+	UpdatedOn  time.Time
+	UpdatedBy  string
+
+	// The secret is only sent to URLs under one of URLPrefixes, and if
+	// Queues is set, only for tasks in those queues
+	URLPrefixes []string `datastore:",noindex"`
+	Queues      []string `datastore:",noindex"`
+}
+
+// allows reports whether the secret can be sent for a task in queue to url
+func (s *Secret) allows(queue, url string) bool {
+	if len(s.Queues) > 0 {
+		found := false
+		for _, q := range s.Queues {
+			if q == queue {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, prefix := range s.URLPrefixes {
+		if urlHasPrefix(url, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// secretRef matches a placeholder such as {{secret:crm_token}}
+var secretRef = regexp.MustCompile(`\{\{secret:([A-Za-z0-9_.\-]+)\}\}`)
+
+// validSecretName matches the names that can be used in placeholders
+var validSecretName = regexp.MustCompile(`^[A-Za-z0-9_.\-]+$`)
+
+// getSecretsKey decodes the secrets key from the environment
+func getSecretsKey() ([]byte, error) {
+	k := os.Getenv(SecretsKeyEnv)
+	if k == "" {
+		return nil, errors.New(SecretsKeyEnv + " is not set")
+	}
+	key, err := base64.StdEncoding.DecodeString(k)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not valid base64: %s",
+			SecretsKeyEnv, err.Error())
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("%s must be 32 bytes", SecretsKeyEnv)
+	}
+	return key, nil
+}
+
+// saveSecret encrypts and stores a secret
+func saveSecret(ctx context.Context, s *Secret) error {
+	if !validSecretName.MatchString(s.Name) {
+		return fmt.Errorf("Invalid secret name: %s", s.Name)
+	}
+	if len(s.URLPrefixes) == 0 {
+		return errors.New("A secret needs at least one URL prefix")
+	}
+	for _, prefix := range s.URLPrefixes {
+		if !isCallbackURL(prefix) {
+			return fmt.Errorf("URL prefixes must be absolute http or https "+
+				"URLs: %s", prefix)
+		}
+	}
+	for _, q := range s.Queues {
+		if _, ok := getQueueDef(q); !ok {
+			return fmt.Errorf("Invalid QueueName: %s", q)
+		}
+	}
+	key, err := getSecretsKey()
+	if err != nil {
+		return err
+	}
+	if s.Ciphertext, err = seal(key, []byte(s.Value)); err != nil {
+		return err
+	}
+	s.Value = ""
+	s.UpdatedOn = time.Now().UTC()
+	k := datastore.NewKey(ctx, SecretKind, s.Name, 0, nil)
+	_, err = datastore.Put(ctx, k, s)
+	return err
+}
+
+// getSecretValue loads and decrypts a secret, if it can be sent for the
+// task
+func getSecretValue(ctx context.Context, name string,
+	task *Task) (string, error) {
+
+	var s Secret
+	k := datastore.NewKey(ctx, SecretKind, name, 0, nil)
+	if err := datastore.Get(ctx, k, &s); err != nil &&
+		!isErrFieldMismatch(err) {
+		return "", err
+	}
+	if !s.allows(task.QueueName, task.URL) {
+		return "", fmt.Errorf("Secret %s can't be sent to %s", name,
+			task.URL)
+	}
+	key, err := getSecretsKey()
+	if err != nil {
+		return "", err
+	}
+	b, err := unseal(key, s.Ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("Unable to decrypt secret %s: %s",
+			name, err.Error())
+	}
+	return string(b), nil
+}
+
+// checkSecretRefs makes sure every secret referenced by the task's headers
+// exists and can be sent to the task's URL, so bad references are caught
+// by enq instead of on every retry.
+func checkSecretRefs(ctx context.Context, task *Task) ([]FieldError, error) {
+	var fields []FieldError
+	for _, h := range task.Headers {
+		for _, m := range secretRef.FindAllStringSubmatch(h.Value, -1) {
+			var s Secret
+			k := datastore.NewKey(ctx, SecretKind, m[1], 0, nil)
+			err := datastore.Get(ctx, k, &s)
+			if err == datastore.ErrNoSuchEntity {
+				fields = append(fields, FieldError{"headers", FieldInvalid,
+					fmt.Sprintf("Header %s refers to unknown secret %s",
+						h.Name, m[1])})
+			} else if err != nil && !isErrFieldMismatch(err) {
+				return nil, err
+			} else if !s.allows(task.QueueName, task.URL) {
+				fields = append(fields, FieldError{"headers", FieldNotAllowed,
+					fmt.Sprintf("Secret %s can't be sent to this url or queue",
+						m[1])})
+			}
+		}
+	}
+	return fields, nil
+}
+
+// resolveSecrets replaces placeholders in a header value of the task with
+// the secret values.  Secrets are cached in resolved for the rest of the
+// request.
+func resolveSecrets(ctx context.Context, task *Task, value string,
+	resolved map[string]string) (string, error) {
+
+	var err error
+	result := secretRef.ReplaceAllStringFunc(value, func(ref string) string {
+		name := secretRef.FindStringSubmatch(ref)[1]
+		if v, ok := resolved[name]; ok {
+			return v
+		}
+		v, e := getSecretValue(ctx, name, task)
+		if e != nil {
+			if err == nil {
+				err = fmt.Errorf("Unable to resolve secret %s: %s",
+					name, e.Error())
+			}
+			return ref
+		}
+		resolved[name] = v
+		return v
+	})
+	return result, err
+}
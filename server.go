@@ -5,9 +5,13 @@ package pushq
 
 import (
 	"bytes"
+	crand "crypto/rand"
+	"encoding/hex"
 	"html/template"
+	"io"
 	"io/ioutil"
 	"math/rand"
+	"strconv"
 	"strings"
 
 	"golang.org/x/crypto/bcrypt"
@@ -23,6 +27,10 @@ import (
 	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/taskqueue"
 	"google.golang.org/appengine/urlfetch"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // TaskHeader is an HTTP header that gets added to headers for the target URL
@@ -39,6 +47,19 @@ type Task struct {
 	QueueName      string       `datastore:"q" json:"queueName"`
 	Headers        []TaskHeader `datastore:"h,noindex" json:"headers"`
 	TimeoutSeconds int          `datastore:"t" json:"timeoutSeconds"`
+	Retry          *RetryPolicy `datastore:"-" json:"retry,omitempty"`
+
+	// Sealed has the encrypted payload and headers while the task is
+	// in the queue.  See keyring.go.
+	Sealed *SealedData `datastore:"-" json:"sealed,omitempty"`
+
+	// TaskName is set by enq, and identifies the task across attempts
+	TaskName string `datastore:"tn" json:"taskName,omitempty"`
+
+	// RequestID and TraceParent come from the X-Request-ID and
+	// traceparent headers sent to enq, and are forwarded by callback
+	RequestID   string `datastore:"rid" json:"requestId,omitempty"`
+	TraceParent string `datastore:"tp,noindex" json:"traceParent,omitempty"`
 }
 
 // TaskLog is a model for log entries about tasks
@@ -48,16 +69,47 @@ type TaskLog struct {
 	UTC     time.Time `datastore:"utc" json:"enqUTC"`
 	Code    int       `datastore:"cd" json:"code"`
 	Message string    `datastore:"msg" json:"message"`
+
+	// Redacted lists what the queue's redaction rules masked
+	Redacted []string `datastore:"rd,noindex" json:"redacted"`
+
+	// Encrypted is the JSON SealedData for the payload and headers, which
+	// are blank when the log is encrypted
+	Encrypted []byte `datastore:"enc,noindex" json:"-"`
+
+	// Attempt is the delivery attempt, starting at 1.  It is 0 for enq logs.
+	Attempt int `datastore:"att" json:"attempt"`
+
+	// ResponseBody is the start of the body returned by the URL
+	ResponseBody string `datastore:"rb,noindex" json:"responseBody"`
+}
+
+// LogDetail has the optional parts of a TaskLog for saveLog
+type LogDetail struct {
+	Attempt      int
+	ResponseBody string
 }
 
+// MaxResponseBodyLog is the number of bytes of callback responses to log
+const MaxResponseBodyLog int64 = 4096
+
 // TaskLogKind is the name of the TaskLog table
 const TaskLogKind string = "TaskLog"
 
-// QNames is the list of queues, which should match queue.yaml
-var QNames *map[string]bool
+// PausedDelay is how long callback holds a task from a paused queue
+// before it is delivered to callback again.
+const PausedDelay = 60 * time.Second
 
 var templates *template.Template
 
+// templateFiles are the admin console templates
+var templateFiles = []string{
+	"tmpl/admin.html", "tmpl/header.html", "tmpl/footer.html",
+	"tmpl/keys.html", "tmpl/logs.html", "tmpl/queues.html",
+	"tmpl/queue.html", "tmpl/secrets.html", "tmpl/logdetail.html",
+	"tmpl/counters.html", "tmpl/alerts.html",
+}
+
 // init initializes the web application by configuring routes
 func init() {
 
@@ -72,10 +124,47 @@ func init() {
 	muxRouter.HandleFunc("/admin", admin).Methods("GET")
 	muxRouter.HandleFunc("/admin/keys", keys).Methods("GET")
 	muxRouter.HandleFunc("/admin/logs/{name}", logs).Methods("GET")
+	muxRouter.HandleFunc("/admin/log/{id}", logDetail).Methods("GET")
 	muxRouter.HandleFunc("/admin/newapikey", newAPIKey).Methods("GET")
 	muxRouter.HandleFunc("/admin/delapikey", delAPIKey).Methods("POST")
+	muxRouter.HandleFunc("/admin/setKeyQueues", setKeyQueues).Methods("POST")
 	muxRouter.HandleFunc("/admin/toggleQueueLogs",
 		toggleQueueLogs).Methods("POST")
+	muxRouter.HandleFunc("/admin/toggleQueueActive",
+		toggleQueueActive).Methods("POST")
+	muxRouter.HandleFunc("/admin/queues", queues).Methods("GET")
+	muxRouter.HandleFunc("/admin/queues/{name}", queue).Methods("GET")
+	muxRouter.HandleFunc("/admin/queueRegistry",
+		queueRegistry).Methods("GET")
+	muxRouter.HandleFunc("/admin/saveQueueConfig",
+		saveQueueConfig).Methods("POST")
+	muxRouter.HandleFunc("/admin/delQueueConfig",
+		delQueueConfig).Methods("POST")
+	muxRouter.HandleFunc("/admin/syncQueues", syncQueues).Methods("POST")
+	muxRouter.HandleFunc("/admin/secrets", secrets).Methods("GET")
+	muxRouter.HandleFunc("/admin/setSecret", setSecret).Methods("POST")
+	muxRouter.HandleFunc("/admin/delSecret", delSecret).Methods("POST")
+	muxRouter.HandleFunc("/admin/counters", counters).Methods("GET")
+	muxRouter.HandleFunc("/admin/setCounterShards",
+		setCounterShards).Methods("POST")
+	muxRouter.HandleFunc("/admin/migrateCounters",
+		migrateCounters).Methods("POST")
+	muxRouter.HandleFunc("/admin/alerts", alerts).Methods("GET")
+	muxRouter.HandleFunc("/admin/saveAlertRule",
+		saveAlertRule).Methods("POST")
+	muxRouter.HandleFunc("/admin/delAlertRule", delAlertRule).Methods("POST")
+	muxRouter.HandleFunc("/admin/purgeQueue", purgeQueue).Methods("POST")
+	muxRouter.HandleFunc("/admin/audit/{id}/snapshot",
+		auditSnapshot).Methods("GET")
+
+	// Cron jobs, see cron.yaml
+	muxRouter.HandleFunc("/cron/purgeLogs", purgeLogs).Methods("GET")
+	muxRouter.HandleFunc("/cron/compactCounters",
+		compactCounters).Methods("GET")
+	muxRouter.HandleFunc("/cron/flushCounters", flushCounters).Methods("GET")
+	muxRouter.HandleFunc("/cron/evaluateAlerts", evaluateAlerts).Methods("GET")
+	muxRouter.HandleFunc("/cron/sampleQueueStats",
+		sampleQueueStats).Methods("GET")
 
 	// REST API
 	muxRouter.HandleFunc("/enq", enq).Methods("POST")
@@ -83,30 +172,42 @@ func init() {
 	muxRouter.HandleFunc("/test", test).Methods("POST")
 	muxRouter.HandleFunc("/testerr", testerr).Methods("POST")
 	muxRouter.HandleFunc("/counts", getAllCounts).Methods("GET")
-
-	// Make sure this matches queue.yaml
+	muxRouter.HandleFunc("/counts/series", getCountSeries).Methods("GET")
+	muxRouter.HandleFunc("/counts/latency", getLatency).Methods("GET")
+	muxRouter.HandleFunc("/counts/today", getCountsToday).Methods("GET")
+	muxRouter.HandleFunc("/logs", getLogs).Methods("GET")
+	muxRouter.HandleFunc("/queues/stats", getQueueStats).Methods("GET")
+	muxRouter.HandleFunc("/metrics", metrics).Methods("GET")
+
+	// Health checks
+	muxRouter.HandleFunc("/healthz", healthz).Methods("GET")
+	muxRouter.HandleFunc("/readyz", readyz).Methods("GET")
+
+	// Load the list of queues from queue.yaml.
 	// These also end up getting entries in the QStat table
-	qNames := map[string]bool{
-		"default":     true,
-		"crm":         true,
-		"campaigns":   true,
-		"integration": true,
-		"reports":     true,
-		"messaging":   true,
+	// and in the QueueConfig registry.
+	defs, err := loadQueueYAML(QueueYAMLFile)
+	if err != nil {
+		panic(err)
 	}
+	QueueDefs = defs
 
-	QNames = &qNames
+	if err = initTracing(); err != nil {
+		panic(err)
+	}
+	if err = initReportLocation(); err != nil {
+		panic(err)
+	}
 
 	funcMap := template.FuncMap{
-		"fmtms":  fmtms,
-		"fmtutc": fmtutc,
+		"fmtms":   fmtms,
+		"fmtutc":  fmtutc,
+		"preview": preview,
 	}
 
 	// Cache templates
 	templates = template.Must(
-		template.New("all").Funcs(funcMap).ParseFiles("tmpl/admin.html",
-			"tmpl/header.html", "tmpl/footer.html", "tmpl/keys.html",
-			"tmpl/logs.html"))
+		template.New("all").Funcs(funcMap).ParseFiles(templateFiles...))
 
 	http.Handle("/", muxRouter)
 }
@@ -141,37 +242,73 @@ type APIKey struct {
 	Key        string
 	Secret     string `datastore:"-"`
 	SecretHash []byte
+
+	// Queues limits the logs the key can read.  Empty means all queues.
+	Queues []string
+
+	// Scopes are extra rights, e.g. ScopeMetrics
+	Scopes []string
+}
+
+// HasScope checks if the key has been given a scope
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CanReadQueue checks if the key has access to a queue's logs
+func (k *APIKey) CanReadQueue(name string) bool {
+	if len(k.Queues) == 0 {
+		return true
+	}
+	for _, q := range k.Queues {
+		if q == name {
+			return true
+		}
+	}
+	return false
 }
 
 // auth checks to make sure the caller has rights to use the REST API.
 // This is not the same as the admin console auth, which is based on
 // Google accounts.  This auth relies on API Keys.
 func auth(ctx context.Context, r *http.Request) bool {
+	_, ok := authKey(ctx, r)
+	return ok
+}
+
+// authKey checks the caller's API Key like auth, and returns the key
+func authKey(ctx context.Context, r *http.Request) (*APIKey, bool) {
 
 	//log.Debugf(ctx, "auth request: %+v", r)
 
 	key := r.Header.Get(XAPIKEY)
 	if key == "" {
 		log.Debugf(ctx, "%s missing", XAPIKEY)
-		return false
+		return nil, false
 	}
 
 	secret := r.Header.Get(XAPISECRET)
-	if key == "" {
+	if secret == "" {
 		log.Debugf(ctx, "%s missing", XAPISECRET)
-		return false
+		return nil, false
 	}
 
 	k := datastore.NewKey(ctx, APIKeyKind, key, 0, nil)
 	apiKey := APIKey{}
-	if err := datastore.Get(ctx, k, &apiKey); err != nil {
+	if err := datastore.Get(ctx, k, &apiKey); err != nil &&
+		!isErrFieldMismatch(err) {
 		log.Debugf(ctx, "Error retrieving %s: %s", APIKeyKind, err.Error())
-		return false
+		return nil, false
 	}
 
 	err := bcrypt.CompareHashAndPassword(apiKey.SecretHash, []byte(secret))
 
-	return err == nil
+	return &apiKey, err == nil
 }
 
 // genKeySecret auto-generates an API Key and Secret, and the bcrypt Hash
@@ -203,44 +340,81 @@ func genKeySecret(apiKey *APIKey) error {
 	return nil
 }
 
-func incrementCounters(ctx context.Context,
-	name string, now time.Time, by int64) {
+// addCounters adds an event for the metric in each counter period to the
+// batch.  queue and url are blank to count events for all of them.
+func addCounters(b *CounterBatch, metric, queue, url string, now time.Time,
+	by int64) {
 
-	countAllName := name
-
-	// All
-	if err := Increment(ctx, countAllName, by); err != nil {
-		log.Errorf(ctx, err.Error())
-	}
-
-	countTodayName := countAllName + getTodayf(now)
-
-	// Today
-	if err := Increment(ctx, countTodayName, by); err != nil {
-		log.Errorf(ctx, err.Error())
+	for _, period := range counterPeriods {
+		b.Add(newCounterKey(metric, queue, url, period, now), by)
 	}
 }
 
 // saveLog saves a record to datastore with task info.
+// The queue's redaction rules are applied to the logged copy of the task.
 func saveLog(
 	ctx context.Context,
+	qc *QueueConfig,
 	task *Task,
+	detail *LogDetail,
 	logType string,
 	code int,
 	message string,
 ) {
 
+	ctx, span := startSpan(ctx, "saveLog",
+		trace.WithAttributes(attribute.String("pushq.log_type", logType)))
+	defer span.End()
+
 	var tl TaskLog
 	tl.Task = *task
+	tl.Redacted = redactTask(&tl.Task, &qc.Redact)
+	if detail != nil {
+		tl.Attempt = detail.Attempt
+		tl.ResponseBody = detail.ResponseBody
+		if qc.Redact.MaxPayloadBytes > 0 &&
+			len(tl.ResponseBody) > qc.Redact.MaxPayloadBytes {
+			tl.ResponseBody = truncateUTF8(tl.ResponseBody,
+				qc.Redact.MaxPayloadBytes)
+			tl.Redacted = append(tl.Redacted, "response body truncated")
+		}
+	}
 	tl.LogType = logType
 	tl.Code = code
 	tl.Message = message
 	tl.UTC = time.Now().UTC()
 
+	// Encrypt the payload and headers if there is a keyring.
+	// Never fall back to storing them in clear text.
+	kr, err := getKeyring()
+	if err == nil && kr != nil {
+		err = sealLog(kr, &tl)
+	}
+	if err != nil {
+		log.Errorf(ctx, "Unable to encrypt log: %s", err.Error())
+		spanError(span, err)
+		return
+	}
+
 	key := datastore.NewIncompleteKey(ctx, TaskLogKind, nil)
 	if _, err := datastore.Put(ctx, key, &tl); err != nil {
 		log.Debugf(ctx, err.Error())
+		spanError(span, err)
+		return
+	}
+
+	var b CounterBatch
+	countLog(&b, tl.QueueName, tl.UTC)
+	commitCounters(ctx, &b, tl.UTC)
+}
+
+// newTaskName creates a unique name for a task in the queue
+func newTaskName() (string, error) {
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		return "", err
 	}
+	return "t-" + hex.EncodeToString(b), nil
 }
 
 // enq enqueues a task
@@ -249,10 +423,17 @@ func enq(w http.ResponseWriter, r *http.Request) {
 
 	ctx := appengine.NewContext(r)
 
+	// The caller's trace, if any, is the parent of the enq span
+	callerTP, _ := parseTraceParent(r.Header.Get(TraceParentHeader))
+	ctx, span := startSpan(withTraceParent(ctx, callerTP), "enq",
+		trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
 	log.Debugf(ctx, "enq called")
 
 	if !auth(ctx, r) {
-		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		apiError(w, http.StatusUnauthorized, ErrCodeUnauthorized,
+			"Not authorized")
 		return
 	}
 
@@ -260,28 +441,125 @@ func enq(w http.ResponseWriter, r *http.Request) {
 	var jsonb []byte
 	jsonb, _ = ioutil.ReadAll(r.Body)
 	if err = json.Unmarshal(jsonb, &task); err != nil {
-		http.Error(w, "Invalid JSON", 400)
+		apiError(w, 400, ErrCodeInvalidJSON, "Invalid JSON")
 		return
 	}
 
-	qNames := *QNames
-	if !qNames[task.QueueName] {
-		http.Error(w, "Invalid QueueName", http.StatusNotAcceptable)
+	// Correlation IDs come from headers, not the posted task
+	task.RequestID = cleanRequestID(r.Header.Get(XRequestID))
+	task.TraceParent = callerTP
+	w.Header().Set(XRequestID, task.RequestID)
+
+	fields := validateTask(&task)
+
+	// Make sure the queue is deployed and registered
+	var qc QueueConfig
+	var ok bool
+	if task.QueueName != "" {
+		if ok, err = isValidQueue(ctx, &qc, task.QueueName); err != nil {
+			apiError(w, http.StatusInternalServerError, ErrCodeInternal,
+				err.Error())
+			return
+		} else if !ok {
+			fields = append(fields, FieldError{"queueName", FieldInvalid,
+				"Invalid QueueName"})
+		}
+	}
+
+	// Fill in the queue's defaults and check its limits
+	if ok {
+		fields = append(fields, applyQueuePolicy(&task, &qc)...)
+	}
+
+	// Make sure secrets referenced in headers exist
+	secretFields, err := checkSecretRefs(ctx, &task)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal,
+			err.Error())
+		return
+	}
+	fields = append(fields, secretFields...)
+
+	if len(fields) > 0 {
+		apiFieldErrors(w, fields)
 		return
 	}
 
 	// Get the Queue config
 	var s QStat
 	if err = getOrCreateQStat(ctx, &s, task.QueueName); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal,
+			err.Error())
+		return
+	}
+
+	// Paused queues either refuse new tasks or hold them until resumed
+	if !s.Active && s.RejectWhilePaused {
+		apiError(w, http.StatusServiceUnavailable, ErrCodeQueuePaused,
+			"Queue is paused")
+		return
+	}
+
+	// Name the task, so that its logs can be found across attempts
+	if task.TaskName, err = newTaskName(); err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal,
+			err.Error())
+		return
+	}
+
+	span.SetAttributes(taskAttributes(&task)...)
+
+	// When tracing is on, callback's spans are children of the
+	// taskqueue.Add span, through the traceparent in the task
+	addCtx, addSpan := startSpan(ctx, "taskqueue.Add",
+		trace.WithSpanKind(trace.SpanKindProducer))
+	if tp := spanTraceParent(addCtx); tp != "" {
+		task.TraceParent = tp
+	}
+
+	// Encrypt the payload and headers of the queued copy of the task.
+	// The clear text task is still used for logs, which are encrypted
+	// separately after redaction.
+	queued := task
+	kr, err := getKeyring()
+	if err == nil && kr != nil {
+		err = sealTask(kr, &queued)
+	}
+	if err != nil {
+		spanError(addSpan, err)
+		addSpan.End()
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal,
+			err.Error())
+		return
+	}
+
+	// Use the entire task, with defaults, as the payload
+	if jsonb, err = json.Marshal(queued); err != nil {
+		spanError(addSpan, err)
+		addSpan.End()
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal,
+			err.Error())
+		return
+	}
+
+	// Many large headers can still take the task past App Engine's limit
+	if len(jsonb) > MaxTaskBytes {
+		addSpan.End()
+		apiFieldErrors(w, []FieldError{{"payload", FieldTooLarge,
+			"task is more than App Engine's max of " +
+				strconv.Itoa(MaxTaskBytes) + " bytes"}})
 		return
 	}
 
 	// Create the task
 	t := taskqueue.Task{}
+	t.Name = task.TaskName
 	t.Path = "/callback"
 	t.Delay = time.Duration(task.DelaySeconds) * time.Second
-	t.Payload = jsonb // Use the entire submitted task as the payload
+	t.Payload = jsonb
+	if task.Retry != nil {
+		t.RetryOptions = task.Retry.RetryOptions()
+	}
 
 	// If we are testing errors, only retry once
 	if strings.HasSuffix(task.URL, "testerr") {
@@ -291,26 +569,38 @@ func enq(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Enqueue the task
-	if _, err := taskqueue.Add(ctx, &t, task.QueueName); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		incrementCounters(ctx, "EnqueueError", time.Now().UTC(), 1)
+	_, err = taskqueue.Add(addCtx, &t, task.QueueName)
+	if err != nil {
+		spanError(addSpan, err)
+	}
+	addSpan.End()
+	if err != nil {
+		spanError(span, err)
+		apiError(w, http.StatusInternalServerError, ErrCodeEnqueue,
+			err.Error())
+		var b CounterBatch
+		nowutc := time.Now().UTC()
+		addCounters(&b, EnqErrCt, "", "", nowutc, 1)
+		commitCounters(ctx, &b, nowutc)
 
 		if s.LogsEnabled {
-			saveLog(ctx, &task, "EnqueueError", 0, err.Error())
+			saveLog(ctx, &qc, &task, nil, "EnqueueError", 0, err.Error())
 		}
 
 		return
 	}
 
 	if s.LogsEnabled {
-		saveLog(ctx, &task, "Enqueue", 0, "")
+		saveLog(ctx, &qc, &task, nil, "Enqueue", 0, "")
 	}
 
 	nowutc := time.Now().UTC()
 
-	incrementCounters(ctx, EnqCt, nowutc, 1)
-	incrementCounters(ctx, EnqCt+task.QueueName, nowutc, 1)
-	incrementCounters(ctx, EnqCt+task.URL, nowutc, 1)
+	var b CounterBatch
+	addCounters(&b, EnqCt, "", "", nowutc, 1)
+	addCounters(&b, EnqCt, task.QueueName, "", nowutc, 1)
+	addCounters(&b, EnqCt, "", task.URL, nowutc, 1)
+	commitCounters(ctx, &b, nowutc)
 	recordURL(ctx, task.URL)
 }
 
@@ -355,7 +645,33 @@ func callback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Debugf(ctx, "callback payload: %+v", task)
+	// Decrypt the payload and headers.  The receiver gets the task as it
+	// was submitted, not the encrypted copy.
+	body := jsonb
+	if task.Sealed != nil {
+		kr, err := getKeyring()
+		if err == nil {
+			err = unsealTask(kr, &task)
+		}
+		if err != nil {
+			log.Errorf(ctx, "Unable to decrypt task: %s", err.Error())
+			http.Error(w, "Unable to decrypt task", 500)
+			return
+		}
+		if body, err = json.Marshal(task); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// The payload and headers may be secret, so only the task is named
+	log.Debugf(ctx, "callback task %s to %s", task.TaskName, task.URL)
+
+	// Continue the trace from enq
+	ctx, span := startSpan(withTraceParent(ctx, task.TraceParent),
+		"callback", trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(taskAttributes(&task)...))
+	defer span.End()
 
 	// Double check the queue name
 	if xq != task.QueueName {
@@ -370,16 +686,71 @@ func callback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Attempts start at 1.  Tasks held while the queue was paused are
+	// new tasks, so their attempts start over.
+	var detail LogDetail
+	detail.Attempt, _ = strconv.Atoi(r.Header.Get("X-AppEngine-TaskRetryCount"))
+	detail.Attempt++
+	span.SetAttributes(attribute.Int("pushq.attempt", detail.Attempt))
+
+	// Get the registry config, which has the log redaction rules.
+	// A queue that is no longer registered is still delivered.
+	var qc QueueConfig
+	err = getOrCreateQueueConfig(ctx, &qc, task.QueueName)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Hold the task if the queue is paused.  Re-enqueue it with a delay
+	// rather than failing, so a long pause doesn't use up retries.
+	if !s.Active {
+		t := taskqueue.Task{}
+		t.Path = "/callback"
+		t.Delay = PausedDelay
+		t.Payload = jsonb
+
+		// Keep the retry limits the task was enqueued with.  Tasks from
+		// before the queue had a default get the current one.
+		if task.Retry != nil {
+			t.RetryOptions = task.Retry.RetryOptions()
+		} else if !qc.DefaultRetry.IsZero() {
+			t.RetryOptions = qc.DefaultRetry.RetryOptions()
+		}
+		if _, err = taskqueue.Add(ctx, &t, task.QueueName); err != nil {
+			// Let the task queue retry it instead
+			http.Error(w, "Queue is paused", http.StatusServiceUnavailable)
+			return
+		}
+
+		if s.LogsEnabled {
+			saveLog(ctx, &qc, &task, &detail, "CallbackPaused", 0, "")
+		}
+
+		return
+	}
+
 	// Initialize the http client
 	var client = urlfetch.Client(ctx)
+	if task.TimeoutSeconds <= 0 {
+		task.TimeoutSeconds = DefaultTimeoutSeconds
+	}
 	client.Timeout = time.Duration(task.TimeoutSeconds) * time.Second
 
-	req, err := http.NewRequest("POST", task.URL, bytes.NewBuffer(jsonb))
+	reqCtx, reqSpan := startSpan(ctx, "POST",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.method", "POST"),
+			attribute.String("http.url", task.URL)))
+	defer reqSpan.End()
+
+	req, err := http.NewRequest("POST", task.URL, bytes.NewBuffer(body))
 	if err != nil {
+		spanError(reqSpan, err)
 		log.Debugf(ctx, "Unable to create callback request: %s", err.Error())
 
 		if s.LogsEnabled {
-			saveLog(ctx, &task, "NewRequestError", 0, err.Error())
+			saveLog(ctx, &qc, &task, &detail, "NewRequestError", 0, err.Error())
 		}
 
 		http.Error(w, "Callback Failed", 400)
@@ -387,56 +758,115 @@ func callback(w http.ResponseWriter, r *http.Request) {
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	// Add custom task headers
+	// Forward the correlation IDs, as a child span of the caller's trace.
+	// With tracing on, the child is the span for this request.
+	if task.RequestID != "" {
+		req.Header.Set(XRequestID, task.RequestID)
+	}
+	if tp := spanTraceParent(reqCtx); tp != "" {
+		req.Header.Set(TraceParentHeader, tp)
+	} else if tp := childTraceParent(task.TraceParent); tp != "" {
+		req.Header.Set(TraceParentHeader, tp)
+	}
+
+	// Add custom task headers, with secret placeholders resolved.
+	// The task and its logs keep the placeholders.  The secrets' URLs are
+	// checked again, since they may have changed since enq.
+	resolved := map[string]string{}
 	for _, h := range task.Headers {
-		req.Header.Set(h.Name, h.Value)
+		v, err := resolveSecrets(ctx, &task, h.Value, resolved)
+		if err != nil {
+			log.Errorf(ctx, err.Error())
+
+			if s.LogsEnabled {
+				saveLog(ctx, &qc, &task, &detail, "SecretError", 0, err.Error())
+			}
+
+			http.Error(w, "Callback Failed", 500)
+			return
+		}
+		req.Header.Set(h.Name, v)
 	}
 
 	// Make the request
 	var resp *http.Response
 	before := time.Now().UTC()
 	if resp, err = client.Do(req); err != nil {
+		elapsed := time.Now().UTC().Sub(before)
 		log.Debugf(ctx, "Callback client failed: %s", err.Error())
+		spanError(reqSpan, err)
 
 		if s.LogsEnabled {
-			saveLog(ctx, &task, "ClientError", 0, err.Error())
+			saveLog(ctx, &qc, &task, &detail, "ClientError", 0, err.Error())
 		}
 
+		// A URL that can't be reached counts as an error, like a non-200
+		nowutc := time.Now().UTC()
+		var b CounterBatch
+		addCounters(&b, ErrCt, "", "", nowutc, 1)
+		addCounters(&b, ErrCt, "", task.URL, nowutc, 1)
+		addCounters(&b, ErrCt, task.QueueName, "", nowutc, 1)
+		recordLatency(ctx, &b, task.QueueName, task.URL, nowutc,
+			int64(elapsed/time.Millisecond),
+			callbackTimedOut(err, elapsed, client.Timeout))
+		commitCounters(ctx, &b, nowutc)
 		http.Error(w, "Callback Failed", 400)
 		return
-	} else if resp.StatusCode != http.StatusOK {
+	}
+	after := time.Now().UTC()
+	defer resp.Body.Close()
+	reqSpan.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	if resp.StatusCode != http.StatusOK {
+		reqSpan.SetStatus(codes.Error, resp.Status)
+	}
+	reqSpan.End()
+
+	// Keep the start of the response for the logs.  One more byte is
+	// read so that truncateUTF8 can tell whether the last rune was cut.
+	if s.LogsEnabled {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body,
+			MaxResponseBodyLog+1))
+		detail.ResponseBody = truncateUTF8(string(b), int(MaxResponseBodyLog))
+	}
+
+	// Elapsed time
+	diff := after.Sub(before)
+	elapsedNs := diff.Nanoseconds()
+	ms := elapsedNs / int64(1000000)
+
+	if resp.StatusCode != http.StatusOK {
 		log.Debugf(ctx, "Callback Failed: %s", resp.Status)
 
 		if s.LogsEnabled {
-			saveLog(ctx, &task, "CallbackError",
+			saveLog(ctx, &qc, &task, &detail, "CallbackError",
 				resp.StatusCode, resp.Status)
 		}
 
 		nowutc := time.Now().UTC()
-		incrementCounters(ctx, ErrCt, nowutc, 1)
-		incrementCounters(ctx, ErrCt+task.URL, nowutc, 1)
-		incrementCounters(ctx, ErrCt+task.QueueName, nowutc, 1)
+		var b CounterBatch
+		addCounters(&b, ErrCt, "", "", nowutc, 1)
+		addCounters(&b, ErrCt, "", task.URL, nowutc, 1)
+		addCounters(&b, ErrCt, task.QueueName, "", nowutc, 1)
+		recordLatency(ctx, &b, task.QueueName, task.URL, nowutc, ms, false)
+		commitCounters(ctx, &b, nowutc)
 		http.Error(w, "Callback Failed", 400)
 		return
 	}
 
-	// Elapsed time
-	after := time.Now().UTC()
-	diff := after.Sub(before)
-	elapsedNs := diff.Nanoseconds()
-	ms := elapsedNs / int64(1000000)
-
 	// Store elapsed time for average calculations
 	nowutc := time.Now().UTC()
-	incrementCounters(ctx, AvgTotalCt+task.URL, nowutc, 1)
-	incrementCounters(ctx, AvgAccumCt+task.URL, nowutc, ms)
-	incrementCounters(ctx, AvgTotalCt+task.QueueName, nowutc, 1)
-	incrementCounters(ctx, AvgAccumCt+task.QueueName, nowutc, ms)
+	var b CounterBatch
+	addCounters(&b, AvgTotalCt, "", task.URL, nowutc, 1)
+	addCounters(&b, AvgAccumCt, "", task.URL, nowutc, ms)
+	addCounters(&b, AvgTotalCt, task.QueueName, "", nowutc, 1)
+	addCounters(&b, AvgAccumCt, task.QueueName, "", nowutc, ms)
+	recordLatency(ctx, &b, task.QueueName, task.URL, nowutc, ms, false)
+	commitCounters(ctx, &b, nowutc)
 
-	log.Debugf(ctx, "callback got resp in %dns: %+v", elapsedNs, resp)
+	log.Debugf(ctx, "callback got %s in %dns", resp.Status, elapsedNs)
 
 	if s.LogsEnabled {
-		saveLog(ctx, &task, "CallbackSuccess",
+		saveLog(ctx, &qc, &task, &detail, "CallbackSuccess",
 			resp.StatusCode, resp.Status)
 	}
 }
@@ -460,41 +890,384 @@ func testerr(w http.ResponseWriter, r *http.Request) {
 
 // CounterTotal is used to pass totals back as JSON from getAllCounts
 type CounterTotal struct {
-	Name  string
+	Name string
+	CounterKey
 	Total int64
 }
 
+// getAllCounts returns a page of counters and their totals.  The cursor
+// for the next page is in the X-Next-Cursor header.
 func getAllCounts(w http.ResponseWriter, r *http.Request) {
 
 	ctx := appengine.NewContext(r)
 
-	if !auth(ctx, r) {
-		http.Error(w, "Not authorized", http.StatusUnauthorized)
+	apiKey, ok := authKey(ctx, r)
+	if !ok {
+		apiError(w, http.StatusUnauthorized, ErrCodeUnauthorized,
+			"Not authorized")
+		return
+	}
+
+	f, fields := parseCountsFilter(r)
+	queue := ""
+	if f.Queue != nil {
+		queue = *f.Queue
+	}
+	if !checkCounterQuery(w, apiKey, queue, fields) {
 		return
 	}
 
-	counterNames, err := GetAllCounterNames(ctx)
+	totals, next, err := queryCounters(ctx, &f)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal,
+			err.Error())
 		return
 	}
+	if totals == nil {
+		totals = []CounterTotal{}
+	}
 
-	var totals []CounterTotal
+	w.Header().Set("Content-Type", "application/json")
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
 
-	for _, counterName := range counterNames {
-		total := CounterTotal{Name: counterName}
-		var c int64
-		var err error
-		if c, err = Count(ctx, counterName); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	enc := json.NewEncoder(w)
+	enc.Encode(totals)
+}
+
+// checkCounterQuery writes an error response if there are field errors,
+// or if the API Key can't read the queue's counters.  Keys limited to some
+// queues must ask for one of them.
+func checkCounterQuery(w http.ResponseWriter, apiKey *APIKey, queue string,
+	fields []FieldError) bool {
+
+	if queue == "" && len(apiKey.Queues) > 0 {
+		fields = append(fields, FieldError{"queue", FieldRequired,
+			"queue is required for keys limited to some queues"})
+	}
+	if len(fields) > 0 {
+		writeAPIError(w, http.StatusBadRequest, APIError{
+			Code:    ErrCodeValidation,
+			Message: "Invalid query",
+			Fields:  fields,
+		})
+		return false
+	}
+	if queue != "" && !apiKey.CanReadQueue(queue) {
+		apiError(w, http.StatusForbidden, ErrCodeForbidden,
+			"Not authorized for queue "+queue)
+		return false
+	}
+	return true
+}
+
+// MaxSeriesBuckets limits the number of buckets in a time series
+const MaxSeriesBuckets int = 24 * 31
+
+// SeriesResponse is the JSON returned by getCountSeries
+type SeriesResponse struct {
+	Metric string         `json:"metric"`
+	Queue  string         `json:"queue,omitempty"`
+	URL    string         `json:"url,omitempty"`
+	Period string         `json:"period"`
+	Points []CounterPoint `json:"points"`
+}
+
+// getCountSeries returns a range of hourly or daily buckets for one
+// counter, for charts
+func getCountSeries(w http.ResponseWriter, r *http.Request) {
+
+	ctx := appengine.NewContext(r)
+
+	apiKey, ok := authKey(ctx, r)
+	if !ok {
+		apiError(w, http.StatusUnauthorized, ErrCodeUnauthorized,
+			"Not authorized")
+		return
+	}
+
+	v := r.URL.Query()
+	k := CounterKey{
+		Metric: v.Get("metric"),
+		Queue:  v.Get("queue"),
+		URL:    v.Get("url"),
+		Period: v.Get("period"),
+	}
+	var fields []FieldError
+	switch k.Metric {
+	case EnqCt, EnqErrCt, ErrCt, AvgTotalCt, AvgAccumCt:
+	case BacklogSamplesCt, BacklogTasksCt, BacklogInFlightCt,
+		BacklogExecutedCt, BacklogAgeCt, BacklogRateCt:
+		if k.Queue == "" {
+			fields = append(fields, FieldError{"queue", FieldRequired,
+				"queue is required for backlog metrics"})
 		}
-		total.Total = c
-		totals = append(totals, total)
+	case "":
+		fields = append(fields, FieldError{"metric", FieldRequired,
+			"metric is required"})
+	default:
+		fields = append(fields, FieldError{"metric", FieldInvalid,
+			"Unknown metric " + k.Metric})
+	}
+	if k.Queue != "" && k.URL != "" {
+		fields = append(fields, FieldError{"url", FieldNotAllowed,
+			"Counters are kept by queue or by URL, not both"})
+	}
+	if k.Period == "" {
+		k.Period = PeriodHour
+	}
+	if k.Period != PeriodHour && k.Period != PeriodDay &&
+		k.Period != PeriodMonth {
+		fields = append(fields, FieldError{"period", FieldInvalid,
+			"period must be hour, day or month"})
+	}
+
+	to := time.Now().UTC()
+	if s := v.Get("to"); s != "" {
+		t, err := parseLogTime(s)
+		if err != nil {
+			fields = append(fields, FieldError{"to", FieldInvalid,
+				"to must be formatted as " + LogTimeFormat})
+		}
+		to = t
+	}
+	from := to.Add(-24 * time.Hour)
+	switch k.Period {
+	case PeriodDay:
+		from = to.AddDate(0, 0, -30)
+	case PeriodMonth:
+		from = to.AddDate(-1, 0, 0)
+	}
+	if s := v.Get("from"); s != "" {
+		t, err := parseLogTime(s)
+		if err != nil {
+			fields = append(fields, FieldError{"from", FieldInvalid,
+				"from must be formatted as " + LogTimeFormat})
+		}
+		from = t
+	}
+	span := time.Hour
+	switch k.Period {
+	case PeriodDay:
+		span = 24 * time.Hour
+	case PeriodMonth:
+		span = 31 * 24 * time.Hour
+	}
+	if !from.Before(to) || to.Sub(from) > span*time.Duration(MaxSeriesBuckets) {
+		fields = append(fields, FieldError{"from", FieldInvalid,
+			"from must be before to, with at most " +
+				strconv.Itoa(MaxSeriesBuckets) + " buckets"})
+	}
+
+	if !checkCounterQuery(w, apiKey, k.Queue, fields) {
+		return
+	}
+
+	points, err := CountSeries(ctx, k, from, to)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal,
+			err.Error())
+		return
+	}
+
+	resp := SeriesResponse{
+		Metric: k.Metric,
+		Queue:  k.Queue,
+		URL:    k.URL,
+		Period: k.Period,
+		Points: points,
+	}
+	if resp.Points == nil {
+		resp.Points = []CounterPoint{}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 
 	enc := json.NewEncoder(w)
-	enc.Encode(totals)
+	enc.Encode(resp)
+}
+
+// LatencyResponse is the JSON returned by getLatency
+type LatencyResponse struct {
+	Queue  string    `json:"queue,omitempty"`
+	URL    string    `json:"url,omitempty"`
+	Period string    `json:"period"`
+	Bucket time.Time `json:"bucket"`
+	LatencyStats
+}
+
+// getLatency returns callback latency percentiles for a queue or a URL
+func getLatency(w http.ResponseWriter, r *http.Request) {
+
+	ctx := appengine.NewContext(r)
+
+	apiKey, ok := authKey(ctx, r)
+	if !ok {
+		apiError(w, http.StatusUnauthorized, ErrCodeUnauthorized,
+			"Not authorized")
+		return
+	}
+
+	v := r.URL.Query()
+	resp := LatencyResponse{
+		Queue:  v.Get("queue"),
+		URL:    v.Get("url"),
+		Period: v.Get("period"),
+	}
+	var fields []FieldError
+	if resp.Queue == "" && resp.URL == "" {
+		fields = append(fields, FieldError{"queue", FieldRequired,
+			"queue or url is required"})
+	}
+	if resp.Queue != "" && resp.URL != "" {
+		fields = append(fields, FieldError{"url", FieldNotAllowed,
+			"Counters are kept by queue or by URL, not both"})
+	}
+	if resp.Period == "" {
+		resp.Period = PeriodDay
+	}
+	if resp.Period != PeriodAll && resp.Period != PeriodDay &&
+		resp.Period != PeriodHour {
+		fields = append(fields, FieldError{"period", FieldInvalid,
+			"period must be all, day or hour"})
+	}
+	at := time.Now().UTC()
+	if s := v.Get("at"); s != "" {
+		t, err := parseLogTime(s)
+		if err != nil {
+			fields = append(fields, FieldError{"at", FieldInvalid,
+				"at must be formatted as " + LogTimeFormat})
+		}
+		at = t
+	}
+	if !checkCounterQuery(w, apiKey, resp.Queue, fields) {
+		return
+	}
+
+	resp.Bucket = bucketStart(resp.Period, at)
+	stats, err := getLatencyStats(ctx, resp.Queue, resp.URL, resp.Period, at)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal,
+			err.Error())
+		return
+	}
+	resp.LatencyStats = stats
+
+	w.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(w)
+	enc.Encode(resp)
+}
+
+// getCountsToday returns the counts for a queue or a URL since midnight
+// in the tz timezone, added up from the hourly buckets
+func getCountsToday(w http.ResponseWriter, r *http.Request) {
+
+	ctx := appengine.NewContext(r)
+
+	apiKey, ok := authKey(ctx, r)
+	if !ok {
+		apiError(w, http.StatusUnauthorized, ErrCodeUnauthorized,
+			"Not authorized")
+		return
+	}
+
+	v := r.URL.Query()
+	queue, url := v.Get("queue"), v.Get("url")
+	var fields []FieldError
+	if queue != "" && url != "" {
+		fields = append(fields, FieldError{"url", FieldNotAllowed,
+			"Counters are kept by queue or by URL, not both"})
+	}
+	loc, err := loadTimezone(v.Get("tz"))
+	if err != nil {
+		fields = append(fields, FieldError{"tz", FieldInvalid,
+			"tz must be an IANA timezone name, e.g. America/New_York"})
+	}
+	if !checkCounterQuery(w, apiKey, queue, fields) {
+		return
+	}
+
+	stats, err := getTodayStats(ctx, queue, url, loc, time.Now().UTC())
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal,
+			err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(w)
+	enc.Encode(stats)
+}
+
+// LogEntry is a TaskLog as returned by the logs API
+type LogEntry struct {
+	ID int64 `json:"id"`
+	TaskLog
+	IsEncrypted bool `json:"encrypted"`
+}
+
+// LogsResponse is the JSON returned by getLogs
+type LogsResponse struct {
+	Logs []LogEntry `json:"logs"`
+
+	// Cursor gets the next page.  It is blank on the last page.
+	Cursor string `json:"cursor"`
+}
+
+// getLogs returns a page of task logs as JSON, newest first.
+// Encrypted payloads and headers are not decrypted.
+func getLogs(w http.ResponseWriter, r *http.Request) {
+
+	ctx := appengine.NewContext(r)
+
+	apiKey, ok := authKey(ctx, r)
+	if !ok {
+		apiError(w, http.StatusUnauthorized, ErrCodeUnauthorized,
+			"Not authorized")
+		return
+	}
+
+	f, fields := parseLogFilter(r)
+	f.QueueName = r.URL.Query().Get("queue")
+	if f.QueueName == "" && len(apiKey.Queues) > 0 {
+		fields = append(fields, FieldError{"queue", FieldRequired,
+			"queue is required for keys limited to some queues"})
+	}
+	if len(fields) > 0 {
+		writeAPIError(w, http.StatusBadRequest, APIError{
+			Code:    ErrCodeValidation,
+			Message: "Invalid query",
+			Fields:  fields,
+		})
+		return
+	}
+	if f.QueueName != "" && !apiKey.CanReadQueue(f.QueueName) {
+		apiError(w, http.StatusForbidden, ErrCodeForbidden,
+			"Not authorized for queue "+f.QueueName)
+		return
+	}
+
+	logs, keys, next, err := queryLogs(ctx, &f)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, ErrCodeInternal,
+			err.Error())
+		return
+	}
+
+	resp := LogsResponse{Logs: []LogEntry{}, Cursor: next}
+	for i, tl := range logs {
+		resp.Logs = append(resp.Logs, LogEntry{
+			ID:          keys[i].IntID(),
+			TaskLog:     tl,
+			IsEncrypted: len(tl.Encrypted) > 0,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(w)
+	enc.Encode(resp)
 }
@@ -1,12 +1,13 @@
 package pushq
 
 // First create config.json.
-// goapp serve in a separate console window before running tests.
+// gosrv.sh in a separate console window before running tests.
 // go test to test localhost
 // go test -args [env] to test an environment configured in config.json
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -14,6 +15,14 @@ import (
 	"os"
 	"testing"
 	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 // Environment is a config entry for running tests against local, beta, etc.
@@ -122,8 +131,63 @@ func TestBadQueueName(t *testing.T) {
 	}
 	defer resp.Body.Close()
 	body, _ := ioutil.ReadAll(resp.Body)
-	if resp.StatusCode != http.StatusNotAcceptable {
-		t.Fatalf("Did not get http.StatusNotAcceptable from %s: %s", url, body)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Did not get http.StatusBadRequest from %s: %s", url, body)
+	}
+
+	var e APIErrorResponse
+	if err = json.Unmarshal(body, &e); err != nil {
+		t.Fatalf("Unable to unmarshal JSON APIErrorResponse: %s", body)
+	}
+	if e.Error.Code != ErrCodeValidation || len(e.Error.Fields) != 1 ||
+		e.Error.Fields[0].Field != "queueName" {
+		t.Fatalf("Expected a queueName field error: %s", body)
+	}
+}
+
+func TestEnqFieldErrors(t *testing.T) {
+	url := testEnv.APIURL + "/enq"
+
+	client := &http.Client{
+		Timeout: time.Second * 10,
+	}
+
+	var task Task
+	task.Headers = []TaskHeader{TaskHeader{Name: "Bad Name", Value: "X"}}
+	task.QueueName = "default"
+	task.TimeoutSeconds = -1
+	task.URL = "/test"
+
+	jsonb, err := json.Marshal(task)
+	if err != nil {
+		t.Fatal("Unable to marshal test task")
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonb))
+	setAuth(req)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Did not get http.StatusBadRequest from %s: %s", url, body)
+	}
+
+	var e APIErrorResponse
+	if err = json.Unmarshal(body, &e); err != nil {
+		t.Fatalf("Unable to unmarshal JSON APIErrorResponse: %s", body)
+	}
+	found := map[string]bool{}
+	for _, f := range e.Error.Fields {
+		found[f.Field] = true
+	}
+	for _, field := range []string{"url", "timeoutSeconds", "headers"} {
+		if !found[field] {
+			t.Fatalf("Expected a %s field error: %s", field, body)
+		}
 	}
 }
 
@@ -242,3 +306,917 @@ func TestCounts(t *testing.T) {
 		fmt.Println(t.Name, ": ", t.Total)
 	}
 }
+
+func TestParseQueueYAML(t *testing.T) {
+	defs, err := loadQueueYAML(QueueYAMLFile)
+	if err != nil {
+		t.Fatalf("Unable to load %s: %s", QueueYAMLFile, err.Error())
+	}
+
+	var crm QueueDef
+	for _, d := range defs {
+		if d.Name == "crm" {
+			crm = d
+		}
+	}
+	if crm.Rate != "10/s" || crm.RetryLimit != 7 || crm.AgeLimit != "2d" {
+		t.Fatalf("Unexpected crm queue: %+v", crm)
+	}
+
+	if _, err = parseQueueYAML([]byte("queue:\n- name: crm\n")); err == nil {
+		t.Fatal("Expected an error when the default queue is missing")
+	}
+
+	defs, err = parseQueueYAML([]byte("queue:\n- name: default\n" +
+		"  rate: 30/m\n  bucket_size: 20\n"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if defs[0].BucketSize != 20 {
+		t.Fatalf("Unexpected bucket size: %+v", defs[0])
+	}
+	if rate, err := parseQueueRate(defs[0].Rate); err != nil || rate != 0.5 {
+		t.Fatalf("Expected 30/m to be 0.5/s, got %f", rate)
+	}
+	if _, err = parseQueueRate("10/w"); err == nil {
+		t.Fatal("Expected an error for an invalid rate unit")
+	}
+}
+
+func TestURLHasPrefix(t *testing.T) {
+	prefix := "https://api.example.com/hooks"
+	allowed := []string{
+		"https://api.example.com/hooks",
+		"https://api.example.com/hooks/crm?id=1",
+		"https://API.example.com/hooks/",
+	}
+	for _, u := range allowed {
+		if !urlHasPrefix(u, prefix) {
+			t.Fatalf("Expected %s to be allowed", u)
+		}
+	}
+	denied := []string{
+		"https://api.example.com.evil.net/hooks",
+		"https://api.example.com@evil.net/hooks",
+		"https://api.example.com:8443/hooks",
+		"http://api.example.com/hooks",
+		"https://api.example.com/hooksevil",
+		"https://api.example.com/",
+		"https://user@api.example.com/hooks",
+	}
+	for _, u := range denied {
+		if urlHasPrefix(u, prefix) {
+			t.Fatalf("Expected %s not to be allowed", u)
+		}
+	}
+
+	// A prefix without a path allows the whole host
+	if !urlHasPrefix("https://api.example.com/any", "https://api.example.com") {
+		t.Fatal("Expected any path on the host to be allowed")
+	}
+	if urlHasPrefix("https://api.example.com.evil.net/",
+		"https://api.example.com") {
+		t.Fatal("Expected a longer host not to be allowed")
+	}
+
+	qc := QueueConfig{Name: "crm", AllowedURLPrefixes: []string{prefix}}
+	task := Task{URL: "https://api.example.com@evil.net/hooks"}
+	fields := applyQueuePolicy(&task, &qc)
+	if len(fields) != 1 || fields[0].Field != "url" {
+		t.Fatalf("Expected a url field error, got %v", fields)
+	}
+	qc.AllowedURLPrefixes = []string{"api.example.com"}
+	if err := validatePolicy(&qc); err == nil {
+		t.Fatal("Expected a prefix without a scheme to be invalid")
+	}
+}
+
+func TestDefaultMaxPayload(t *testing.T) {
+	qc := QueueConfig{Name: "crm"}
+	task := Task{URL: "https://example.com",
+		Payload: string(make([]byte, DefaultMaxPayloadBytes+1))}
+	fields := applyQueuePolicy(&task, &qc)
+	if len(fields) != 1 || fields[0].Code != FieldTooLarge {
+		t.Fatalf("Expected the default payload limit, got %v", fields)
+	}
+
+	qc.MaxPayloadBytes = 10
+	task.Payload = "01234567890"
+	if fields = applyQueuePolicy(&task, &qc); len(fields) != 1 {
+		t.Fatalf("Expected the queue's payload limit, got %v", fields)
+	}
+
+	qc.MaxPayloadBytes = MaxTaskBytes
+	if err := validatePolicy(&qc); err == nil {
+		t.Fatal("Expected a limit over the default max to be invalid")
+	}
+}
+
+func TestSecretAllows(t *testing.T) {
+	s := Secret{Name: "crm_token",
+		URLPrefixes: []string{"https://crm.example.com/hooks"}}
+	if !s.allows("crm", "https://crm.example.com/hooks/contact") {
+		t.Fatal("Expected the secret to be sent under its prefix")
+	}
+	if s.allows("crm", "https://evil.example.net/hooks") ||
+		s.allows("crm", "https://crm.example.com.evil.net/hooks") {
+		t.Fatal("Expected the secret not to be sent to other hosts")
+	}
+
+	s.Queues = []string{"crm"}
+	if s.allows("reports", "https://crm.example.com/hooks") {
+		t.Fatal("Expected the secret not to be sent for other queues")
+	}
+
+	// A secret without URL prefixes isn't sent anywhere
+	var old Secret
+	if old.allows("crm", "https://crm.example.com/hooks") {
+		t.Fatal("Expected an unscoped secret not to be sent")
+	}
+}
+
+func TestRedactTask(t *testing.T) {
+	var task Task
+	task.Headers = []TaskHeader{{Name: "Authorization", Value: "Bearer X"}}
+	task.Payload = `{"customer":{"email":"a@b.c"},"items":[{"ssn":"1"},{"ssn":"2"}]}`
+
+	rules := RedactRules{
+		Headers: []string{"authorization"},
+		Paths:   []string{"customer.email", "items.*.ssn"},
+	}
+
+	logged := task
+	redacted := redactTask(&logged, &rules)
+	if len(redacted) != 3 {
+		t.Fatalf("Expected 3 redactions: %v", redacted)
+	}
+	if logged.Headers[0].Value != RedactedValue {
+		t.Fatalf("Header was not masked: %+v", logged.Headers)
+	}
+	if task.Headers[0].Value != "Bearer X" {
+		t.Fatal("The original task's headers were changed")
+	}
+	expected := `{"customer":{"email":"[REDACTED]"},` +
+		`"items":[{"ssn":"[REDACTED]"},{"ssn":"[REDACTED]"}]}`
+	if logged.Payload != expected {
+		t.Fatalf("Unexpected payload: %s", logged.Payload)
+	}
+
+	rules = RedactRules{MaxPayloadBytes: 5}
+	logged = task
+	redactTask(&logged, &rules)
+	if logged.Payload != task.Payload[:5] {
+		t.Fatalf("Payload was not truncated: %s", logged.Payload)
+	}
+
+	// A rune isn't split by truncation
+	task.Payload = `{"name":"Zoë"}`
+	rules = RedactRules{MaxPayloadBytes: 12}
+	logged = task
+	redactTask(&logged, &rules)
+	if logged.Payload != `{"name":"Zo` {
+		t.Fatalf("Payload was not truncated to a rune: %q", logged.Payload)
+	}
+}
+
+func TestSealTask(t *testing.T) {
+	oldKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	newKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+
+	kr, err := parseKeyring("k1:" + oldKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var task Task
+	task.Payload = "ABC"
+	task.Headers = []TaskHeader{{Name: "X-Test", Value: "1"}}
+	if err = sealTask(kr, &task); err != nil {
+		t.Fatal(err.Error())
+	}
+	if task.Payload != "" || task.Headers != nil || task.Sealed == nil {
+		t.Fatalf("Task was not sealed: %+v", task)
+	}
+
+	// Rotate, keeping the old key for decryption
+	if kr, err = parseKeyring("k2:" + newKey + ",k1:" + oldKey); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = unsealTask(kr, &task); err != nil {
+		t.Fatal(err.Error())
+	}
+	if task.Payload != "ABC" || len(task.Headers) != 1 || task.Sealed != nil {
+		t.Fatalf("Task was not unsealed: %+v", task)
+	}
+}
+
+func TestSealedFromClient(t *testing.T) {
+	kr, err := parseKeyring("k1:" + base64.StdEncoding.EncodeToString(
+		make([]byte, 32)))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// enq only accepts clear text
+	task := Task{URL: "https://example.com", QueueName: "crm",
+		Sealed: &SealedData{KeyID: "k1"}}
+	fields := validateTask(&task)
+	if len(fields) != 1 || fields[0].Field != "sealed" {
+		t.Fatalf("Expected a sealed field error, got %v", fields)
+	}
+
+	// A Sealed the task came with is replaced by the checked fields
+	task.Payload = "ABC"
+	if err = sealTask(kr, &task); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = unsealTask(kr, &task); err != nil {
+		t.Fatal(err.Error())
+	}
+	if task.Payload != "ABC" {
+		t.Fatalf("Expected the payload to be sealed, got %+v", task)
+	}
+}
+
+func TestParseLogFilter(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/logs?queue=crm&type=Enqueue&limit=10",
+		nil)
+	f, fields := parseLogFilter(r)
+	if len(fields) != 0 || f.LogType != "Enqueue" || f.Limit != 10 {
+		t.Fatalf("Unexpected filter %+v %v", f, fields)
+	}
+
+	r, _ = http.NewRequest("GET", "/logs?cursor=not-a-cursor&limit=0", nil)
+	_, fields = parseLogFilter(r)
+	if len(fields) != 2 || fields[0].Field != "limit" ||
+		fields[1].Field != "cursor" || fields[1].Code != FieldInvalid {
+		t.Fatalf("Expected limit and cursor field errors, got %v", fields)
+	}
+}
+
+func TestParseCountsCursor(t *testing.T) {
+	for _, cursor := range []string{"CounterConfig:not-a-cursor", "Other:",
+		"CounterRollup"} {
+		r, _ := http.NewRequest("GET", "/counts?cursor="+cursor, nil)
+		_, fields := parseCountsFilter(r)
+		if len(fields) != 1 || fields[0].Field != "cursor" {
+			t.Fatalf("Expected a cursor field error for %s, got %v", cursor,
+				fields)
+		}
+	}
+
+	// The rollups start from the beginning
+	r, _ := http.NewRequest("GET", "/counts?cursor=CounterRollup:", nil)
+	if _, fields := parseCountsFilter(r); len(fields) != 0 {
+		t.Fatalf("Unexpected field errors %v", fields)
+	}
+}
+
+func TestLogs(t *testing.T) {
+	url := testEnv.APIURL + "/logs?queue=default&limit=10"
+
+	req, err := http.NewRequest("GET", url, nil)
+	setAuth(req)
+
+	client := &http.Client{
+		Timeout: time.Second * 10,
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Did not get 200 OK from %s: %s", url, body)
+	}
+
+	var logs LogsResponse
+	if err = json.Unmarshal(body, &logs); err != nil {
+		t.Fatal("Unable to unmarshal JSON LogsResponse")
+	}
+	if len(logs.Logs) > 10 {
+		t.Fatalf("Expected at most 10 logs, got %d", len(logs.Logs))
+	}
+	for i := 1; i < len(logs.Logs); i++ {
+		if logs.Logs[i].UTC.After(logs.Logs[i-1].UTC) {
+			t.Fatal("Expected logs to be newest first")
+		}
+	}
+}
+
+func TestTraceParent(t *testing.T) {
+	tp := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	parsed, traceID := parseTraceParent(tp)
+	if parsed != tp || traceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("Unexpected parse of %s: %s %s", tp, parsed, traceID)
+	}
+
+	child := childTraceParent(tp)
+	if child[:36] != tp[:36] || child[52:] != tp[52:] {
+		t.Fatalf("Child %s is not in the same trace as %s", child, tp)
+	}
+	if child == tp {
+		t.Fatal("Child should have a new span ID")
+	}
+
+	for _, bad := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+	} {
+		if p, _ := parseTraceParent(bad); p != "" {
+			t.Fatalf("Expected %q to be rejected", bad)
+		}
+		if childTraceParent(bad) != "" {
+			t.Fatalf("Expected no child for %q", bad)
+		}
+	}
+}
+
+func TestCounterKeyName(t *testing.T) {
+	now := time.Date(2017, 3, 4, 15, 30, 0, 0, time.UTC)
+
+	// These were the same counter when names were concatenated
+	a := newCounterKey(EnqCt, "", "http://x/2017-03-04", PeriodAll, now)
+	b := newCounterKey(EnqCt, "", "http://x/", PeriodDay, now)
+	if a.Name() == b.Name() {
+		t.Fatalf("Counter names collide: %s", a.Name())
+	}
+
+	h := newCounterKey(EnqCt, "default", "", PeriodHour, now)
+	if h.Name() != "Enqueue|default||hour|2017-03-04T15" {
+		t.Fatalf("Unexpected hourly counter name: %s", h.Name())
+	}
+	if !h.Bucket.Equal(now.Truncate(time.Hour)) {
+		t.Fatalf("Unexpected hourly bucket: %v", h.Bucket)
+	}
+
+	m := newCounterKey(ErrCt, "", "", PeriodMonth, now)
+	if m.Name() != "Error|||month|2017-03" {
+		t.Fatalf("Unexpected monthly counter name: %s", m.Name())
+	}
+	if !nextBucket(PeriodMonth, m.Bucket).Equal(
+		time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Unexpected bucket after %v", m.Bucket)
+	}
+}
+
+func TestLegacyCounterKeys(t *testing.T) {
+	legacy := legacyCounterKeys([]string{"default"}, []string{"http://x/"})
+
+	for old, expected := range map[string]CounterKey{
+		"Enqueue":         {Metric: EnqCt, Period: PeriodAll},
+		"Enqueuedefault":  {Metric: EnqCt, Queue: "default", Period: PeriodAll},
+		"Errorhttp://x/":  {Metric: ErrCt, URL: "http://x/", Period: PeriodAll},
+		"AvgAccumdefault": {Metric: AvgAccumCt, Queue: "default", Period: PeriodAll},
+		"EnqueueError":    {Metric: EnqErrCt, Period: PeriodAll},
+	} {
+		if k, ok := legacy[old]; !ok || k != expected {
+			t.Fatalf("Expected %s to fold into %+v, got %+v", old, expected, k)
+		}
+	}
+	if len(legacy) != len(legacyMetrics)*3+1 {
+		t.Fatalf("Unexpected number of legacy counters: %d", len(legacy))
+	}
+}
+
+func TestTodayStart(t *testing.T) {
+	for _, c := range []struct {
+		tz    string
+		now   time.Time
+		start time.Time
+	}{
+		// Still the 3rd in New York
+		{"America/New_York", time.Date(2017, 3, 4, 3, 0, 0, 0, time.UTC),
+			time.Date(2017, 3, 3, 5, 0, 0, 0, time.UTC)},
+		// Clocks went forward on the 12th, which started in EST
+		{"America/New_York", time.Date(2017, 3, 13, 3, 0, 0, 0, time.UTC),
+			time.Date(2017, 3, 12, 5, 0, 0, 0, time.UTC)},
+		// Midnight is 18:30 UTC, in the 18:00 hourly bucket
+		{"Asia/Kolkata", time.Date(2017, 3, 4, 12, 0, 0, 0, time.UTC),
+			time.Date(2017, 3, 3, 18, 0, 0, 0, time.UTC)},
+		{"UTC", time.Date(2017, 3, 4, 12, 0, 0, 0, time.UTC),
+			time.Date(2017, 3, 4, 0, 0, 0, 0, time.UTC)},
+	} {
+		loc, err := time.LoadLocation(c.tz)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if start := todayStart(loc, c.now); !start.Equal(c.start) {
+			t.Fatalf("Today at %v in %s started %v, expected %v", c.now,
+				c.tz, start, c.start)
+		}
+	}
+}
+
+func TestHourCountsCache(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC)
+	current := bucketStart(PeriodHour, now)
+	if hourCountsTTL(current, now) != hourCountsRecent {
+		t.Fatal("Expected the current hour to be cached briefly")
+	}
+
+	// Write-behind deltas can still arrive for the last hour
+	if hourCountsTTL(current.Add(-time.Hour), now) != hourCountsRecent {
+		t.Fatal("Expected the last hour to be cached briefly")
+	}
+	if hourCountsTTL(current.Add(-2*time.Hour), now) != hourCountsExpiry {
+		t.Fatal("Expected a settled hour to be cached for a day")
+	}
+
+	if hourCountsKey("crm", "", current) == hourCountsKey("", "crm", current) ||
+		hourCountsKey("crm", "", current) ==
+			hourCountsKey("crm", "", current.Add(time.Hour)) {
+		t.Fatal("Expected keys to differ by queue, URL and hour")
+	}
+}
+
+func TestCountSeries(t *testing.T) {
+	url := testEnv.APIURL + "/counts/series?metric=Enqueue&period=hour"
+
+	req, err := http.NewRequest("GET", url, nil)
+	setAuth(req)
+
+	client := &http.Client{
+		Timeout: time.Second * 10,
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Did not get 200 OK from %s: %s", url, body)
+	}
+
+	var series SeriesResponse
+	if err = json.Unmarshal(body, &series); err != nil {
+		t.Fatal("Unable to unmarshal JSON SeriesResponse")
+	}
+	if len(series.Points) < 24 || len(series.Points) > 25 {
+		t.Fatalf("Expected a day of hourly buckets, got %d",
+			len(series.Points))
+	}
+}
+
+func TestLatencyPercentile(t *testing.T) {
+	counts := make([]int64, len(LatencyBoundsMS)+1)
+	counts[latencyBucket(40)] = 90   // 25 to 50ms
+	counts[latencyBucket(700)] = 9   // 500 to 1000ms
+	counts[latencyBucket(45000)] = 1 // over 30000ms
+
+	if p := latencyPercentile(counts, 0.5, 45000); p < 25 || p > 50 {
+		t.Fatalf("Expected p50 from 25 to 50ms, got %f", p)
+	}
+	if p := latencyPercentile(counts, 0.95, 45000); p < 500 || p > 1000 {
+		t.Fatalf("Expected p95 from 500 to 1000ms, got %f", p)
+	}
+	if p := latencyPercentile(counts, 1, 45000); p != 45000 {
+		t.Fatalf("Expected p100 to be the max, got %f", p)
+	}
+	if p := latencyPercentile(make([]int64, len(counts)), 0.5, 0); p != 0 {
+		t.Fatalf("Expected 0 with no durations, got %f", p)
+	}
+}
+
+// timeoutError is a net.Error like the one http.Client returns on timeout
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestCallbackLatencyBucket(t *testing.T) {
+	limit := 30 * time.Second
+	if !callbackTimedOut(timeoutError{}, time.Second, limit) {
+		t.Fatal("Expected a timeout error to be a timeout")
+	}
+	if !callbackTimedOut(fmt.Errorf("canceled"), limit, limit) {
+		t.Fatal("Expected a failure at the timeout to be a timeout")
+	}
+	if callbackTimedOut(fmt.Errorf("refused"), time.Second, limit) {
+		t.Fatal("Expected a refused connection not to be a timeout")
+	}
+
+	// A timeout at 30s would be in the 30000ms bucket by duration
+	if b := callbackLatencyBucket(30000, true); b != len(LatencyBoundsMS) {
+		t.Fatalf("Expected timeouts in the overflow bucket, got %d", b)
+	}
+	if b := callbackLatencyBucket(30000, false); b != latencyBucket(30000) {
+		t.Fatalf("Unexpected bucket %d", b)
+	}
+}
+
+func TestCounterBatch(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	var b CounterBatch
+	addCounters(&b, EnqCt, "q", "", now, 1)
+	addCounters(&b, EnqCt, "q", "", now.Add(time.Minute), 2)
+	b.Add(newCounterKey(ErrCt, "q", "", PeriodAll, now), 5)
+
+	// The same counters are merged, in the order they were first added
+	if b.Len() != 4 {
+		t.Fatalf("Expected 4 counters, got %d", b.Len())
+	}
+	if b.keys[0].Period != PeriodAll || b.keys[3].Metric != ErrCt {
+		t.Fatalf("Unexpected order %v", b.keys)
+	}
+	if by := b.deltas[b.keys[2].Name()]; by != 3 {
+		t.Fatalf("Expected the hour's increments to add up to 3, got %d", by)
+	}
+
+	parts := b.split(3)
+	if len(parts) != 2 || parts[0].Len() != 3 || parts[1].Len() != 1 {
+		t.Fatalf("Unexpected split %v", parts)
+	}
+	if by := parts[1].deltas[b.keys[3].Name()]; by != 5 {
+		t.Fatalf("Expected the last part to have the ErrCt delta, got %d", by)
+	}
+	var empty CounterBatch
+	if len(empty.split(maxXGGroups)) != 0 {
+		t.Fatal("Expected no parts for an empty batch")
+	}
+}
+
+func TestFlushSlots(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 30, 20, 0, time.UTC)
+	first, last := flushSlots(now)
+
+	// The slot that just ended is left for increments still in progress
+	if last != deltaSlotID(now)-2 {
+		t.Fatalf("Expected the last slot to end flushLag ago, got %d", last)
+	}
+
+	// Slots are retried for nearly as long as their entries are kept
+	if first != deltaSlotID(now.Add(-flushWindow)) ||
+		now.Sub(time.Unix(first*60, 0)) >= deltaExpiry {
+		t.Fatalf("Unexpected first slot %d", first)
+	}
+
+	ka := newCounterKey(EnqCt, "a", "", PeriodAll, now)
+	kb := newCounterKey(EnqCt, "b", "", PeriodAll, now)
+	kc := newCounterKey(EnqCt, "c", "", PeriodAll, now)
+	keys := []CounterKey{ka, kb, kc}
+	var dkeys []string
+	for _, k := range keys {
+		dkeys = append(dkeys, deltaKey(last, k.Name()))
+	}
+
+	// Deltas that were flushed, evicted or zero are skipped
+	deltas := map[string]*memcache.Item{
+		dkeys[0]: {Value: []byte("7")},
+		dkeys[2]: {Value: []byte("0")},
+	}
+	b := slotBatch(keys, dkeys, deltas)
+	if b.Len() != 1 || b.deltas[ka.Name()] != 7 {
+		t.Fatalf("Unexpected batch %v", b.deltas)
+	}
+}
+
+func TestContention(t *testing.T) {
+	if n := contention(1, nil); n != 0 {
+		t.Fatalf("Expected no contention on the first attempt, got %d", n)
+	}
+	if n := contention(3, nil); n != 2 {
+		t.Fatalf("Expected 2 contended attempts before a commit, got %d", n)
+	}
+	if n := contention(3, datastore.ErrConcurrentTransaction); n != 3 {
+		t.Fatalf("Expected every attempt to be contended, got %d", n)
+	}
+	if n := contention(1, fmt.Errorf("timeout")); n != 0 {
+		t.Fatalf("Expected other errors not to be contention, got %d", n)
+	}
+
+	// Only the increment that reaches the threshold scales the counter
+	if crossedContention(ShardScaleContention-1, 1) {
+		t.Fatal("Expected no scaling below the threshold")
+	}
+	if !crossedContention(ShardScaleContention, 1) ||
+		!crossedContention(ShardScaleContention+1, 3) {
+		t.Fatal("Expected scaling when the threshold is reached")
+	}
+	if crossedContention(ShardScaleContention+1, 1) {
+		t.Fatal("Expected no scaling after the threshold was passed")
+	}
+
+	if n := scaledShards(defaultShards); n != 2*defaultShards {
+		t.Fatalf("Expected the shards to double, got %d", n)
+	}
+	if n := scaledShards(200); n != MaxCounterShards {
+		t.Fatalf("Expected the shards to stop at the max, got %d", n)
+	}
+	if n := scaledShards(MaxCounterShards); n != MaxCounterShards {
+		t.Fatalf("Expected no scaling past the max, got %d", n)
+	}
+}
+
+func TestValidateAlertRule(t *testing.T) {
+	os.Setenv(AlertWebhookEnv, "")
+	rule := AlertRule{Queue: "default", Type: AlertLatency, Threshold: 500,
+		Webhook: "https://example.com/alerts"}
+	if fields := validateAlertRule(&rule); len(fields) != 0 {
+		t.Fatalf("Unexpected field errors %v", fields)
+	}
+	if rule.Percentile != 95 || rule.WindowMinutes != 60 {
+		t.Fatalf("Expected the defaults to be filled in, got %v", rule)
+	}
+
+	bad := []struct {
+		field string
+		rule  AlertRule
+	}{
+		{"queue", AlertRule{Type: AlertBacklog}},
+		{"queue", AlertRule{Queue: "nope", Type: AlertBacklog}},
+		{"url", AlertRule{Queue: "default", URL: "https://example.com",
+			Type: AlertErrorRate}},
+		{"threshold", AlertRule{Queue: "default", Type: AlertErrorRate,
+			Threshold: 100}},
+		{"windowMinutes", AlertRule{Queue: "default", Type: AlertErrorRate,
+			WindowMinutes: 90}},
+		{"windowMinutes", AlertRule{Queue: "default", Type: AlertErrorRate,
+			WindowMinutes: 25 * 60}},
+		{"webhook", AlertRule{Queue: "default", Type: AlertBacklog,
+			Webhook: "example.com/alerts"}},
+		{"webhook", AlertRule{Queue: "default", Type: AlertBacklog,
+			Webhook: "ftp://example.com/alerts"}},
+	}
+	for _, b := range bad {
+		if b.rule.Webhook == "" {
+			b.rule.Webhook = "https://example.com/alerts"
+		}
+		fields := validateAlertRule(&b.rule)
+		if len(fields) == 0 || fields[0].Field != b.field {
+			t.Fatalf("Expected a %s error for %v, got %v", b.field, b.rule,
+				fields)
+		}
+	}
+
+	// The webhook can come from the environment
+	os.Setenv(AlertWebhookEnv, "https://example.com/alerts")
+	defer os.Setenv(AlertWebhookEnv, "")
+	rule = AlertRule{Queue: "default", Type: AlertBacklog}
+	if fields := validateAlertRule(&rule); len(fields) != 0 {
+		t.Fatalf("Unexpected field errors %v", fields)
+	}
+}
+
+func TestAlertChange(t *testing.T) {
+	rule := AlertRule{Type: AlertErrorRate, Threshold: 5}
+	if firing, changed := alertChange(&rule, 12.5, true); !firing || !changed {
+		t.Fatal("Expected the rule to start firing")
+	}
+	rule.Firing = true
+	if firing, changed := alertChange(&rule, 12.5, true); !firing || changed {
+		t.Fatal("Expected the rule to keep firing without a change")
+	}
+	if firing, changed := alertChange(&rule, 5, true); firing || !changed {
+		t.Fatal("Expected the rule to resolve at the threshold")
+	}
+	if firing, changed := alertChange(&rule, 50, false); firing || !changed {
+		t.Fatal("Expected the rule to resolve without enough callbacks")
+	}
+	rule.Firing = false
+	if firing, changed := alertChange(&rule, 1, true); firing || changed {
+		t.Fatal("Expected the rule to stay resolved")
+	}
+}
+
+func TestReadyResponse(t *testing.T) {
+	checks := map[string]CheckResult{
+		"datastore": {OK: true, MS: 12},
+		"memcache":  {OK: false, Error: "dial tcp 10.0.0.1:11211", MS: 5000},
+	}
+	resp := newReadyResponse(checks)
+	if resp.Ready || !resp.Checks["datastore"] || resp.Checks["memcache"] {
+		t.Fatalf("Unexpected checks %v", resp.Checks)
+	}
+
+	// The public response has no errors or queues
+	b, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"ready":false,"checks":{"datastore":true,"memcache":false}}`
+	if string(b) != expected {
+		t.Fatalf("Unexpected response %s", b)
+	}
+
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	backlogs := []QueueBacklog{
+		{Name: "a", Tasks: 3, OldestETA: now.Add(-time.Minute)},
+		{Name: "b", Tasks: 3, OldestETA: now.Add(-time.Hour)},
+		{Name: "c", Tasks: 3, OldestETA: now.Add(-time.Hour)},
+		{Name: "d"},
+	}
+	queues := queueReadiness(backlogs, map[string]bool{"c": true}, now)
+	statuses := []string{QueueOK, QueueBacklogged, QueuePaused, QueueOK}
+	for i, q := range queues {
+		if q.Status != statuses[i] {
+			t.Fatalf("Expected %s to be %s, got %s", q.Name, statuses[i],
+				q.Status)
+		}
+	}
+}
+
+func TestVisibleQueues(t *testing.T) {
+	if len(visibleQueues(nil)) != len(QueueDefs) {
+		t.Fatal("Expected every queue for keys that aren't limited")
+	}
+
+	// A queue that was removed from queue.yaml is left out
+	names := visibleQueues([]string{"crm", "removed"})
+	if len(names) != 1 || names[0] != "crm" {
+		t.Fatalf("Unexpected queues %v", names)
+	}
+}
+
+func TestAddBacklogSample(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC)
+	q := QueueBacklog{Name: "crm", Tasks: 4, InFlight: 2, Executed1Minute: 9,
+		OldestETA: now.Add(-90 * time.Second), EnforcedRate: 2.5}
+	var b CounterBatch
+	addBacklogSample(&b, q, now)
+	addBacklogSample(&b, QueueBacklog{Name: "crm"}, now)
+
+	// The samples are added up in each period's bucket
+	expected := map[string]int64{
+		BacklogSamplesCt:  2,
+		BacklogTasksCt:    4,
+		BacklogInFlightCt: 2,
+		BacklogExecutedCt: 9,
+		BacklogAgeCt:      90,
+		BacklogRateCt:     2500,
+	}
+	if b.Len() != len(expected)*len(backlogPeriods) {
+		t.Fatalf("Expected %d counters, got %d",
+			len(expected)*len(backlogPeriods), b.Len())
+	}
+	for metric, by := range expected {
+		for _, period := range backlogPeriods {
+			k := newCounterKey(metric, "crm", "", period, now)
+			if b.deltas[k.Name()] != by {
+				t.Fatalf("Expected %s to be %d, got %d", k.Name(), by,
+					b.deltas[k.Name()])
+			}
+		}
+	}
+
+	// A task that isn't due yet has no age
+	var future CounterBatch
+	q.OldestETA = now.Add(time.Minute)
+	addBacklogSample(&future, q, now)
+	k := newCounterKey(BacklogAgeCt, "crm", "", PeriodHour, now)
+	if future.deltas[k.Name()] != 0 {
+		t.Fatalf("Expected no age, got %d", future.deltas[k.Name()])
+	}
+}
+
+func TestEncodeSnapshot(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	var pending []PendingTask
+	for i := 0; i < snapshotMaxTasks; i++ {
+		pending = append(pending, PendingTask{
+			TaskName:    fmt.Sprintf("task-%04d", i),
+			URL:         fmt.Sprintf("https://example.com/%01000d", i),
+			EnqueuedUTC: now.Add(-time.Duration(i) * time.Second),
+		})
+	}
+
+	b, n, err := encodeSnapshot(pending, snapshotMaxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) > snapshotMaxBytes || n == 0 || n >= len(pending) {
+		t.Fatalf("Expected a capped snapshot, got %d tasks in %d bytes", n,
+			len(b))
+	}
+
+	// The newest tasks are kept
+	var kept []PendingTask
+	if err = json.Unmarshal(b, &kept); err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) != n || kept[0].TaskName != "task-0000" {
+		t.Fatalf("Unexpected snapshot of %d tasks", len(kept))
+	}
+
+	b, n, err = encodeSnapshot(pending[:10], snapshotMaxBytes)
+	if err != nil || n != 10 {
+		t.Fatalf("Expected a small snapshot to be whole, got %d", n)
+	}
+	if b, n, _ = encodeSnapshot([]PendingTask{}, snapshotMaxBytes); n != 0 ||
+		string(b) != "[]" {
+		t.Fatalf("Unexpected empty snapshot %s", b)
+	}
+}
+
+func TestAlertWindowStart(t *testing.T) {
+	rule := AlertRule{WindowMinutes: 60}
+	tests := []struct {
+		now, from time.Time
+	}{
+		// Just after the hour, the whole last hour is still in the window
+		{time.Date(2024, 3, 1, 10, 1, 0, 0, time.UTC),
+			time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 3, 1, 9, 59, 0, 0, time.UTC),
+			time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC),
+			time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)},
+		{time.Date(2024, 3, 1, 0, 30, 0, 0, time.UTC),
+			time.Date(2024, 2, 29, 23, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		from := alertWindowStart(&rule, test.now)
+		if !from.Equal(test.from) {
+			t.Fatalf("Expected the window at %s to start at %s, got %s",
+				test.now, test.from, from)
+		}
+		if test.now.Sub(from) < time.Hour {
+			t.Fatalf("Expected the window at %s to cover an hour", test.now)
+		}
+	}
+
+	rule.WindowMinutes = 180
+	now := time.Date(2024, 3, 1, 10, 1, 0, 0, time.UTC)
+	if from := alertWindowStart(&rule, now); !from.Equal(
+		time.Date(2024, 3, 1, 7, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Unexpected start %s", from)
+	}
+}
+
+func TestMetricWriter(t *testing.T) {
+	var m metricWriter
+	m.family("pushq_enqueued_total", "counter", "Tasks enqueued.")
+	m.sample("pushq_enqueued_total", 12, "queue", `a"b`)
+	m.sample("pushq_enqueue_errors_total", 0)
+
+	expected := "# HELP pushq_enqueued_total Tasks enqueued.\n" +
+		"# TYPE pushq_enqueued_total counter\n" +
+		`pushq_enqueued_total{queue="a\"b"} 12` + "\n" +
+		"pushq_enqueue_errors_total 0\n"
+	if m.buf.String() != expected {
+		t.Fatalf("Unexpected metrics:\n%s", m.buf.String())
+	}
+}
+
+func TestSpanTraceParent(t *testing.T) {
+	tp := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx := withTraceParent(context.Background(), tp)
+
+	// Spans are not recorded until there is a tracer provider
+	if _, span := startSpan(ctx, "test"); span.IsRecording() {
+		t.Fatal("Expected tracing to be off")
+	}
+
+	otel.SetTracerProvider(sdktrace.NewTracerProvider())
+	child, span := startSpan(ctx, "test")
+	defer span.End()
+
+	parsed, traceID := parseTraceParent(spanTraceParent(child))
+	if parsed == "" || traceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("Expected a span in the caller's trace, got %q", parsed)
+	}
+	if parsed == tp {
+		t.Fatal("Expected a new span ID")
+	}
+}
+
+func TestCountsFilter(t *testing.T) {
+	url := testEnv.APIURL + "/counts?metric=Enqueue&period=all&limit=5"
+
+	req, err := http.NewRequest("GET", url, nil)
+	setAuth(req)
+
+	client := &http.Client{
+		Timeout: time.Second * 10,
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Did not get 200 OK from %s: %s", url, body)
+	}
+
+	var totals []CounterTotal
+	if err = json.Unmarshal(body, &totals); err != nil {
+		t.Fatal("Unable to unmarshal JSON CounterTotal")
+	}
+	if len(totals) > 5 {
+		t.Fatalf("Expected at most 5 counters, got %d", len(totals))
+	}
+	for _, c := range totals {
+		if c.Metric != EnqCt || c.Period != PeriodAll {
+			t.Fatalf("Counter does not match the filter: %s", c.Name)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package pushq
+
+// This file raises the shard counts of hot counters.  Increments note the
+// transactions that had to be retried or failed because of contention,
+// and a counter that is contended often in a minute gets twice as many
+// shards.  Only transactions on one counter are noted, since a cross-group
+// transaction can't tell which of its counters was contended.  New
+// buckets start with the shards of the bucket before them.
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+// MaxCounterShards is the most shards a counter is scaled up to
+const MaxCounterShards int = 320
+
+// ShardScaleContention is the number of contended increments in a minute
+// that doubles a counter's shards
+const ShardScaleContention uint64 = 3
+
+// contentionKey is the memcache key for a counter's contention count in
+// the current minute
+func contentionKey(name string, now time.Time) string {
+	return fmt.Sprintf("CounterContention:%d:%s", now.Unix()/60,
+		hashName(name))
+}
+
+// contention returns the number of contended attempts of a transaction
+// that ran attempts times and returned err
+func contention(attempts int, err error) uint64 {
+	if err == datastore.ErrConcurrentTransaction {
+		return uint64(attempts)
+	}
+	if attempts > 1 {
+		return uint64(attempts - 1)
+	}
+	return 0
+}
+
+// crossedContention reports whether a counter's contention count just
+// reached ShardScaleContention, when adding n made it c.  Only the
+// increment that crosses it scales the counter.
+func crossedContention(c, n uint64) bool {
+	return c >= ShardScaleContention && c-n < ShardScaleContention
+}
+
+// scaledShards returns the shard count for a contended counter with
+// shards shards, or shards if it can't be scaled further
+func scaledShards(shards int) int {
+	target := shards * 2
+	if target > MaxCounterShards {
+		target = MaxCounterShards
+	}
+	if target < shards {
+		target = shards
+	}
+	return target
+}
+
+// noteContention counts n contended attempts for the counter, and scales
+// it up when it reaches ShardScaleContention.  shards is the counter's
+// current shard count.
+func noteContention(ctx context.Context, k CounterKey, shards int,
+	n uint64) {
+
+	name := k.Name()
+	c, err := memcache.Increment(ctx, contentionKey(name, time.Now()),
+		int64(n), 0)
+	if err != nil || !crossedContention(c, n) {
+		return
+	}
+	target := scaledShards(shards)
+	if target <= shards {
+		return
+	}
+	if err = IncreaseCounterShards(ctx, k, target); err != nil {
+		log.Errorf(ctx, "Unable to scale counter %s: %s", name, err.Error())
+		return
+	}
+	log.Infof(ctx, "Scaled counter %s to %d shards", name, target)
+}
+
+// inheritShards gives new configs for hour and day buckets the shard count
+// of the counter's previous bucket, if it had more.  Hot counters stay
+// scaled up from one bucket to the next.
+func inheritShards(ctx context.Context, keys []CounterKey,
+	cfgs []counterConfig) error {
+
+	var pkeys []*datastore.Key
+	var owners []int
+	for i, k := range keys {
+		if k.Period == PeriodAll {
+			continue
+		}
+		prev := k
+		prev.Bucket = bucketStart(k.Period, k.Bucket.Add(-time.Second))
+		pkeys = append(pkeys, datastore.NewKey(ctx, configKind, prev.Name(),
+			0, nil))
+		owners = append(owners, i)
+	}
+	if len(pkeys) == 0 {
+		return nil
+	}
+
+	prevs := make([]counterConfig, len(pkeys))
+	err := datastore.GetMulti(ctx, pkeys, prevs)
+	if me, ok := err.(appengine.MultiError); ok {
+		for _, e := range me {
+			if e != nil && e != datastore.ErrNoSuchEntity &&
+				!isErrFieldMismatch(e) {
+				return e
+			}
+		}
+	} else if err != nil && !isErrFieldMismatch(err) {
+		return err
+	}
+	for j, prev := range prevs {
+		if cfg := &cfgs[owners[j]]; prev.Shards > cfg.Shards {
+			cfg.Shards = prev.Shards
+		}
+	}
+	return nil
+}
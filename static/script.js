@@ -194,6 +194,19 @@ Pushq.prototype.clsText = function (div, className, text) {
     }
 }
 
+/**
+ * Copy the text of an element to the clipboard.
+ */
+Pushq.prototype.copyText = function(id) {
+    var pushq = this;
+    navigator.clipboard.writeText(pushq.id(id).innerText).then(
+    function() {
+        pushq.alert("Copied");
+    }, function() {
+        pushq.alert("Unable to copy", "error");
+    });
+}
+
 /**
  * Display an alert message.
  */
@@ -267,6 +280,27 @@ Pushq.prototype.deleteKey = function(key) {
     })
 }
 
+/**
+ * Set the queues whose logs an API Key can read.
+ */
+Pushq.prototype.setKeyQueues = function(key) {
+    var pushq = this;
+    var queues = [];
+    var parts = pushq.id("queues_"+key).value.split(",");
+    for (var i = 0; i < parts.length; i++) {
+        var q = parts[i].trim();
+        if (q != "") queues.push(q);
+    }
+    var scopes = [];
+    if (pushq.id("metrics_"+key).checked) scopes.push("metrics");
+    pushq.postApi("setKeyQueues", { Key: key, Queues: queues, Scopes: scopes }, 
+    function() {
+        pushq.alert("Saved queues and scopes for " + key);
+    }, function(msg) {
+        pushq.alert(msg.msg, "error");
+    })
+}
+
 /**
  * Enable or disable logging on a queue.
  */
@@ -280,4 +314,275 @@ Pushq.prototype.toggleQueueLogs = function(name) {
     }, function(msg) {
         pushq.alert(msg.Message, "error");
     })
-}
\ No newline at end of file
+}
+
+/**
+ * Pause or resume a queue, and set whether it rejects new tasks while paused.
+ */
+Pushq.prototype.toggleQueueActive = function(name) {
+    var pushq = this;
+    var active = pushq.id("active_"+name).checked;
+    var reject = pushq.id("reject_"+name).checked;
+    pushq.postApi("toggleQueueActive", 
+        { Name: name, Active: active, RejectWhilePaused: reject }, 
+    function() {
+        window.location = "/admin";
+    }, function(msg) {
+        pushq.alert(msg.msg, "error");
+    })
+}
+
+/**
+ * Split a textarea into trimmed, non-blank lines.
+ */
+Pushq.prototype.lines = function(id) {
+    var lines = [];
+    var parts = this.id(id).value.split("\n");
+    for (var i = 0; i < parts.length; i++) {
+        var line = parts[i].trim();
+        if (line != "") lines.push(line);
+    }
+    return lines;
+}
+
+/**
+ * Save the config on a queue's page to the registry.
+ */
+Pushq.prototype.saveQueueConfig = function(name) {
+    var pushq = this;
+    var num = function(id) {
+        var n = parseFloat(pushq.id(id).value);
+        return isNaN(n) ? 0 : n;
+    };
+    var headers = [];
+    var lines = pushq.lines("qDefaultHeaders");
+    for (var i = 0; i < lines.length; i++) {
+        var c = lines[i].indexOf(":");
+        if (c < 1) {
+            pushq.alert("Headers must be Name: Value", "error");
+            return;
+        }
+        headers.push({ name: lines[i].substring(0, c).trim(), 
+            value: lines[i].substring(c + 1).trim() });
+    }
+    var qc = {
+        Name: name,
+        Description: pushq.id("qDescription").value,
+        DefaultTimeoutSeconds: num("qDefaultTimeoutSeconds"),
+        DefaultHeaders: headers,
+        DefaultRetry: {
+            retryLimit: num("qRetryLimit"),
+            ageLimitSeconds: num("qAgeLimitSeconds"),
+            minBackoffSeconds: num("qMinBackoffSeconds"),
+            maxBackoffSeconds: num("qMaxBackoffSeconds"),
+            maxDoublings: num("qMaxDoublings")
+        },
+        MaxTimeoutSeconds: num("qMaxTimeoutSeconds"),
+        MaxPayloadBytes: num("qMaxPayloadBytes"),
+        AllowedURLPrefixes: pushq.lines("qAllowedURLPrefixes"),
+        LogRetentionDays: num("qLogRetentionDays"),
+        Redact: {
+            Headers: pushq.lines("qRedactHeaders"),
+            Paths: pushq.lines("qRedactPaths"),
+            MaxPayloadBytes: num("qRedactMaxPayloadBytes")
+        }
+    };
+    pushq.postApi("saveQueueConfig", qc, 
+    function() {
+        pushq.alert("Saved " + name);
+    }, function(msg) {
+        pushq.alert(msg.msg, "error");
+    })
+}
+
+/**
+ * Register a queue that may not be in queue.yaml yet.
+ */
+Pushq.prototype.registerQueue = function() {
+    var pushq = this;
+    var name = pushq.id("newQueueName").value;
+    var desc = pushq.id("newQueueDesc").value;
+    pushq.postApi("saveQueueConfig", { Name: name, Description: desc }, 
+    function() {
+        window.location = "/admin/queues";
+    }, function(msg) {
+        pushq.alert(msg.msg, "error");
+    })
+}
+
+/**
+ * Delete a queue from the registry.
+ */
+Pushq.prototype.delQueueConfig = function(name) {
+    var pushq = this;
+    pushq.postApi("delQueueConfig", { Name: name }, 
+    function() {
+        window.location = "/admin/queues";
+    }, function(msg) {
+        pushq.alert(msg.msg, "error");
+    })
+}
+
+/**
+ * Register every queue in queue.yaml and copy its settings.
+ */
+Pushq.prototype.syncQueues = function() {
+    var pushq = this;
+    pushq.postApi("syncQueues", {}, 
+    function() {
+        window.location = "/admin/queues";
+    }, function(msg) {
+        pushq.alert(msg.msg, "error");
+    })
+}
+
+/**
+ * Create or replace a secret.
+ */
+Pushq.prototype.setSecret = function() {
+    var pushq = this;
+    var name = pushq.id("secretName").value;
+    var value = pushq.id("secretValue").value;
+    var data = {
+        Name: name,
+        Value: value,
+        URLPrefixes: pushq.lines("secretURLPrefixes"),
+        Queues: pushq.lines("secretQueues")
+    };
+    pushq.postApi("setSecret", data, 
+    function() {
+        window.location = "/admin/secrets";
+    }, function(msg) {
+        pushq.alert(msg.msg, "error");
+    })
+}
+
+/**
+ * Delete a secret.
+ */
+Pushq.prototype.delSecret = function(name) {
+    var pushq = this;
+    pushq.postApi("delSecret", { Name: name }, 
+    function() {
+        window.location = "/admin/secrets";
+    }, function(msg) {
+        pushq.alert(msg.msg, "error");
+    })
+}
+
+/**
+ * Raise the shard count of a counter.  el is the Save button, which has
+ * the counter's dimensions, in the row with the shard count input.
+ */
+Pushq.prototype.setCounterShards = function(el) {
+    var pushq = this;
+    var input = el.parentNode.parentNode.getElementsByTagName("input")[0];
+    pushq.postApi("setCounterShards", {
+        Metric: el.getAttribute("data-metric"),
+        Queue: el.getAttribute("data-queue"),
+        URL: el.getAttribute("data-url"),
+        Period: el.getAttribute("data-period"),
+        Bucket: el.getAttribute("data-bucket"),
+        Shards: parseInt(input.value, 10)
+    }, 
+    function() {
+        window.location.reload();
+    }, function(msg) {
+        pushq.alert(msg.msg, "error");
+    })
+}
+
+/**
+ * Fold the lifetime counters from before dimensions into the new ones.
+ */
+Pushq.prototype.migrateCounters = function() {
+    var pushq = this;
+    pushq.postApi("migrateCounters", {}, 
+    function(msg) {
+        pushq.alert("Migrated " + msg.data + " counters");
+    }, function(msg) {
+        pushq.alert(msg.msg, "error");
+    })
+}
+
+/**
+ * Save the alert rule in the form on the alerts page.
+ */
+Pushq.prototype.saveAlertRule = function() {
+    var pushq = this;
+    var num = function(id) {
+        var v = parseFloat(pushq.id(id).value);
+        return isNaN(v) ? 0 : v;
+    };
+    pushq.postApi("saveAlertRule", {
+        id: parseInt(pushq.id("alertID").value, 10),
+        queue: pushq.id("alertQueue").value,
+        url: pushq.id("alertURL").value,
+        type: pushq.id("alertType").value,
+        threshold: num("alertThreshold"),
+        percentile: num("alertPercentile"),
+        windowMinutes: num("alertWindow"),
+        minCount: num("alertMinCount"),
+        webhook: pushq.id("alertWebhook").value
+    }, 
+    function() {
+        window.location = "/admin/alerts";
+    }, function(msg) {
+        pushq.alert(msg.msg, "error");
+    })
+}
+
+/**
+ * Fill in the alert rule form from the Edit button's rule.
+ */
+Pushq.prototype.editAlertRule = function(el) {
+    var pushq = this;
+    var fields = {
+        alertID: "data-id",
+        alertQueue: "data-queue",
+        alertURL: "data-url",
+        alertType: "data-type",
+        alertThreshold: "data-threshold",
+        alertPercentile: "data-percentile",
+        alertWindow: "data-window",
+        alertMinCount: "data-mincount",
+        alertWebhook: "data-webhook"
+    };
+    for (var id in fields) {
+        pushq.id(id).value = el.getAttribute(fields[id]);
+    }
+    pushq.id("alertFormTitle").innerText = "Edit Rule";
+}
+
+/**
+ * Delete an alert rule.
+ */
+Pushq.prototype.delAlertRule = function(id) {
+    var pushq = this;
+    pushq.postApi("delAlertRule", { id: id }, 
+    function() {
+        window.location = "/admin/alerts";
+    }, function(msg) {
+        pushq.alert(msg.msg, "error");
+    })
+}
+
+Pushq.prototype.purgeQueue = function(name) {
+    var pushq = this;
+    var confirm = pushq.id("purgeConfirm").value.trim();
+    if (confirm !== name) {
+        pushq.alert("Type the queue name to confirm the purge", "error");
+        return;
+    }
+    var req = {
+        Name: name,
+        Confirm: confirm,
+        Snapshot: pushq.id("purgeSnapshot").checked
+    };
+    pushq.postApi("purgeQueue", req, 
+    function() {
+        window.location = "/admin/queues/" + name;
+    }, function(msg) {
+        pushq.alert(msg.msg, "error");
+    })
+}
@@ -0,0 +1,79 @@
+package pushq
+
+// This file has the correlation IDs that enq accepts and callback forwards:
+// X-Request-ID, and the W3C trace context traceparent header.
+// See https://www.w3.org/TR/trace-context/
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+	"strings"
+)
+
+// XRequestID is the HTTP Header for the correlation ID
+const XRequestID string = "X-Request-ID"
+
+// TraceParentHeader is the W3C trace context header
+const TraceParentHeader string = "traceparent"
+
+// maxRequestIDLen limits the size of caller supplied request IDs
+const maxRequestIDLen int = 128
+
+// traceParentRE matches a version 00 traceparent, and later versions,
+// which may add fields after the flags
+var traceParentRE = regexp.MustCompile(
+	`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})(-.*)?$`)
+
+// randomHex returns n random bytes as hex
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newRequestID creates a correlation ID for tasks submitted without one
+func newRequestID() string {
+	return randomHex(16)
+}
+
+// cleanRequestID returns the caller's request ID if it can be stored
+// and forwarded as is, or a new one
+func cleanRequestID(id string) string {
+	id = strings.TrimSpace(id)
+	if id == "" || len(id) > maxRequestIDLen ||
+		strings.ContainsAny(id, "\r\n") {
+		return newRequestID()
+	}
+	return id
+}
+
+// parseTraceParent validates a traceparent header.  It returns the
+// normalized header and the trace ID, or blanks if the header is invalid,
+// in which case the spec says to ignore it.
+func parseTraceParent(tp string) (string, string) {
+	m := traceParentRE.FindStringSubmatch(strings.TrimSpace(tp))
+	if m == nil {
+		return "", ""
+	}
+	version, traceID, parentID, flags := m[1], m[2], m[3], m[4]
+	if version == "ff" ||
+		traceID == strings.Repeat("0", 32) ||
+		parentID == strings.Repeat("0", 16) {
+		return "", ""
+	}
+	if version == "00" && m[5] != "" {
+		return "", ""
+	}
+	return "00-" + traceID + "-" + parentID + "-" + flags, traceID
+}
+
+// childTraceParent returns the traceparent for a request made on behalf
+// of tp, with the same trace ID and flags and a new span ID.
+func childTraceParent(tp string) string {
+	tp, traceID := parseTraceParent(tp)
+	if tp == "" {
+		return ""
+	}
+	return "00-" + traceID + "-" + randomHex(8) + "-" + tp[len(tp)-2:]
+}
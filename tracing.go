@@ -0,0 +1,133 @@
+package pushq
+
+// This file sets up OpenTelemetry tracing.  Spans are linked across the
+// queue hop by the traceparent stored in the task.  See tracecontext.go.
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"golang.org/x/net/context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TraceExporterEnv is the environment variable that picks the span
+// exporter from SpanExporters.  Tracing is off if it is blank.
+const TraceExporterEnv string = "PUSHQ_TRACE_EXPORTER"
+
+// tracerName is the instrumentation name for PushQ's spans
+const tracerName string = "github.com/LoopLLC/PushQ"
+
+// SpanExporters creates the span exporters that can be picked with
+// PUSHQ_TRACE_EXPORTER.  The bool is true to export each span as it ends,
+// instead of in batches.
+var SpanExporters = map[string]func(context.Context) (sdktrace.SpanExporter,
+	bool, error){
+
+	// OTLP/HTTP, configured with the standard OTEL_EXPORTER_OTLP_*
+	// variables, e.g. OTEL_EXPORTER_OTLP_ENDPOINT
+	"otlp": func(ctx context.Context) (sdktrace.SpanExporter, bool, error) {
+		e, err := otlptracehttp.New(ctx)
+		return e, false, err
+	},
+
+	// Pretty printed JSON on stdout, for local runs
+	"stdout": func(ctx context.Context) (sdktrace.SpanExporter, bool, error) {
+		e, err := stdouttrace.New(stdouttrace.WithPrettyPrint())
+		return e, true, err
+	},
+}
+
+// traceContext reads and writes traceparent headers
+var traceContext = propagation.TraceContext{}
+
+// initTracing installs a tracer provider with the exporter named by
+// PUSHQ_TRACE_EXPORTER.  Without one, spans are not recorded.
+func initTracing() error {
+	name := os.Getenv(TraceExporterEnv)
+	if name == "" {
+		return nil
+	}
+	newExporter, ok := SpanExporters[name]
+	if !ok {
+		return fmt.Errorf("Unknown %s: %s", TraceExporterEnv, name)
+	}
+
+	ctx := context.Background()
+	exporter, sync, err := newExporter(ctx)
+	if err != nil {
+		return err
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the default
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "pushq")),
+		resource.WithFromEnv())
+	if err != nil {
+		return err
+	}
+
+	opts := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+	if sync {
+		opts = append(opts, sdktrace.WithSyncer(exporter))
+	} else {
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(opts...))
+	otel.SetTextMapPropagator(traceContext)
+	return nil
+}
+
+// startSpan starts a span with the global tracer
+func startSpan(ctx context.Context, name string,
+	opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// withTraceParent returns ctx with the remote span from a traceparent
+// header value as its parent
+func withTraceParent(ctx context.Context, tp string) context.Context {
+	if tp == "" {
+		return ctx
+	}
+	h := http.Header{}
+	h.Set(TraceParentHeader, tp)
+	return traceContext.Extract(ctx, propagation.HeaderCarrier(h))
+}
+
+// spanTraceParent returns the traceparent for the span in ctx, or blank
+// if it is not being recorded, as when tracing is off
+func spanTraceParent(ctx context.Context) string {
+	if !trace.SpanFromContext(ctx).IsRecording() {
+		return ""
+	}
+	h := http.Header{}
+	traceContext.Inject(ctx, propagation.HeaderCarrier(h))
+	return h.Get(TraceParentHeader)
+}
+
+// spanError marks the span as failed
+func spanError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// taskAttributes describe a task on a span
+func taskAttributes(task *Task) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("pushq.queue", task.QueueName),
+		attribute.String("pushq.url", task.URL),
+		attribute.String("pushq.task_name", task.TaskName),
+		attribute.String("pushq.request_id", task.RequestID),
+	}
+}
@@ -2,16 +2,24 @@ package pushq
 
 import (
 	"fmt"
+	"net/http"
 	"strings"
 	"time"
 
+	"golang.org/x/net/context"
+
 	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/user"
 )
 
+// Counter metrics, see CounterKey
 const (
 	// EnqCt is the counter name for Enqueued task
 	EnqCt = "Enqueue"
 
+	// EnqErrCt is the counter name for tasks that could not be enqueued
+	EnqErrCt = "EnqueueError"
+
 	// ErrCt is the counter name for errors
 	ErrCt = "Error"
 
@@ -20,23 +28,32 @@ const (
 
 	// AvgAccumCt is the counter name for average accumulators
 	AvgAccumCt = "AvgAccum"
-)
 
-// getTodayf formats "now" as a string for use in storing counters
-func getTodayf(now time.Time) string {
+	// LogsCt is the counter name for task logs saved, see countLog
+	LogsCt = "Logs"
 
-	localt := now
-	loc, err := time.LoadLocation("America/New_York")
-	if err != nil {
-		localt = now.In(loc)
-	}
-	return localt.Format(ISO8601D)
-}
+	// LatencySumCt adds up the milliseconds of the callbacks for each
+	// queue, for the Prometheus histogram's sum
+	LatencySumCt = "LatencySum"
+
+	// LatencyCt is the prefix for the latency histogram counters,
+	// see latencyMetric
+	LatencyCt = "Latency"
+)
 
 func fmtms(ms float32) string {
 	return fmt.Sprintf("%.2f", ms)
 }
 
+// preview shortens s for display in a table
+func preview(s string) string {
+	r := []rune(s)
+	if len(r) <= 50 {
+		return s
+	}
+	return string(r[:50]) + "..."
+}
+
 func fmtutc(t time.Time) string {
 	return strings.Replace(t.String(), " +0000 UTC", "", 1)
 }
@@ -46,3 +63,10 @@ func isErrFieldMismatch(err error) bool {
 	_, ok := err.(*datastore.ErrFieldMismatch)
 	return ok
 }
+
+// isCronRequest checks that a request came from App Engine cron, which
+// sets a header that is removed from external requests.  Admins can also
+// run cron jobs by hand.
+func isCronRequest(ctx context.Context, r *http.Request) bool {
+	return r.Header.Get("X-Appengine-Cron") == "true" || user.IsAdmin(ctx)
+}
@@ -0,0 +1,303 @@
+package pushq
+
+// This file has write-behind counters.  When PUSHQ_COUNTER_WRITE_BEHIND is
+// true, increments are added to deltas in memcache, grouped in one minute
+// slots, and a cron job flushes closed slots to datastore with
+// IncrementMulti.  Totals lag by a few minutes, and deltas that memcache
+// evicts before they are flushed are lost, so it is off by default.
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+// WriteBehindEnv is the environment variable that turns on write-behind
+// counters when it is "true"
+const WriteBehindEnv string = "PUSHQ_COUNTER_WRITE_BEHIND"
+
+// deltaSlot is the length of the slots deltas are grouped in
+const deltaSlot = time.Minute
+
+// flushLag is how long after a slot ends before it is flushed, to leave
+// time for increments that were in progress when it ended
+const flushLag = time.Minute
+
+// deltaExpiry is how long the slot entries are kept in memcache
+const deltaExpiry = time.Hour
+
+// flushLockExpiry releases the lock of a flush that didn't return
+const flushLockExpiry = 5 * time.Minute
+
+// flushWindow is how far back flushCounters looks for slots to flush.  It
+// covers nearly all of deltaExpiry, so a slot that fails to flush is
+// retried on later runs until its entries expire.
+const flushWindow = deltaExpiry - 5*time.Minute
+
+// writeBehind reports whether counters are written behind
+func writeBehind() bool {
+	return os.Getenv(WriteBehindEnv) == "true"
+}
+
+// deltaSlotID returns the slot that holds t
+func deltaSlotID(t time.Time) int64 {
+	return t.Unix() / int64(deltaSlot/time.Second)
+}
+
+// hashName shortens a counter name for memcache keys, which are limited
+// to 250 bytes
+func hashName(name string) string {
+	h := sha1.Sum([]byte(name))
+	return hex.EncodeToString(h[:])
+}
+
+// Memcache keys for a slot.  The slot's counters are listed in numbered
+// entries, and CounterSlotLen is the number of entries.
+func deltaKey(slot int64, name string) string {
+	return fmt.Sprintf("CounterDelta:%d:%s", slot, hashName(name))
+}
+
+func seenKey(slot int64, name string) string {
+	return fmt.Sprintf("CounterSeen:%d:%s", slot, hashName(name))
+}
+
+func slotLenKey(slot int64) string {
+	return fmt.Sprintf("CounterSlotLen:%d", slot)
+}
+
+func slotEntryKey(slot int64, i uint64) string {
+	return fmt.Sprintf("CounterSlot:%d:%d", slot, i)
+}
+
+func flushLockKey(slot int64) string {
+	return fmt.Sprintf("CounterFlush:%d", slot)
+}
+
+// registerDelta lists the counter in the slot, once per slot.  It returns
+// false if the counter could not be listed.
+func registerDelta(ctx context.Context, slot int64, k CounterKey) bool {
+	name := k.Name()
+	err := memcache.Add(ctx, &memcache.Item{
+		Key:        seenKey(slot, name),
+		Value:      []byte{1},
+		Expiration: deltaExpiry,
+	})
+	if err == memcache.ErrNotStored {
+		return true
+	}
+	if err != nil {
+		return false
+	}
+
+	i, err := memcache.Increment(ctx, slotLenKey(slot), 1, 0)
+	if err == nil {
+		err = memcache.JSON.Set(ctx, &memcache.Item{
+			Key:        slotEntryKey(slot, i),
+			Object:     &k,
+			Expiration: deltaExpiry,
+		})
+	}
+	if err != nil {
+		memcache.Delete(ctx, seenKey(slot, name))
+		return false
+	}
+	return true
+}
+
+// addDeltas adds the batch to the deltas for now's slot.  It returns the
+// increments that could not be added, which should be written now.
+func addDeltas(ctx context.Context, b *CounterBatch,
+	now time.Time) *CounterBatch {
+
+	slot := deltaSlotID(now)
+	var direct CounterBatch
+	for _, k := range b.keys {
+		name := k.Name()
+		by := b.deltas[name]
+
+		// Memcache values can't go below zero
+		if by < 0 || !registerDelta(ctx, slot, k) {
+			direct.Add(k, by)
+			continue
+		}
+		_, err := memcache.Increment(ctx, deltaKey(slot, name), by, 0)
+		if err != nil {
+			direct.Add(k, by)
+		}
+	}
+	return &direct
+}
+
+// commitCounters applies a batch of increments, or adds them to the
+// deltas in memcache when counters are written behind
+func commitCounters(ctx context.Context, b *CounterBatch, now time.Time) {
+	if writeBehind() {
+		b = addDeltas(ctx, b, now)
+	}
+	if err := IncrementMulti(ctx, b); err != nil {
+		log.Errorf(ctx, err.Error())
+	}
+}
+
+// flushSlot writes the deltas for a slot to datastore and removes them
+// from memcache.  It returns the number of counters flushed.
+func flushSlot(ctx context.Context, slot int64) (int, error) {
+	// Only one flush for each slot at a time
+	lock := flushLockKey(slot)
+	err := memcache.Add(ctx, &memcache.Item{
+		Key:        lock,
+		Value:      []byte{1},
+		Expiration: flushLockExpiry,
+	})
+	if err == memcache.ErrNotStored {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer memcache.Delete(ctx, lock)
+
+	item, err := memcache.Get(ctx, slotLenKey(slot))
+	if err == memcache.ErrCacheMiss {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseUint(string(item.Value), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	var ekeys []string
+	for i := uint64(1); i <= n; i++ {
+		ekeys = append(ekeys, slotEntryKey(slot, i))
+	}
+	entries, err := memcache.GetMulti(ctx, ekeys)
+	if err != nil {
+		return 0, err
+	}
+	var keys []CounterKey
+	var dkeys []string
+	for _, ekey := range ekeys {
+		item, ok := entries[ekey]
+		if !ok {
+			continue
+		}
+		var k CounterKey
+		if err := json.Unmarshal(item.Value, &k); err != nil {
+			log.Errorf(ctx, "Invalid counter slot entry: %s", err.Error())
+			continue
+		}
+		keys = append(keys, k)
+		dkeys = append(dkeys, deltaKey(slot, k.Name()))
+	}
+	deltas, err := memcache.GetMulti(ctx, dkeys)
+	if err != nil {
+		return 0, err
+	}
+
+	b := slotBatch(keys, dkeys, deltas)
+
+	// Each chunk's deltas are deleted as soon as it commits, so when the
+	// slot is flushed again after a failure only the rest are added
+	flushed := 0
+	var ferr error
+	for _, chunk := range b.split(maxXGGroups) {
+		failed, err := incrementBatch(ctx, chunk)
+		if err != nil {
+			ferr = err
+		}
+		var committed []string
+		for _, k := range chunk.keys {
+			if _, ok := failed.deltas[k.Name()]; !ok {
+				committed = append(committed, deltaKey(slot, k.Name()))
+			}
+		}
+		err = memcache.DeleteMulti(ctx, committed)
+		if _, ok := err.(appengine.MultiError); err != nil && !ok {
+			log.Errorf(ctx, "Unable to delete flushed deltas for slot %d: %s",
+				slot, err.Error())
+		}
+		flushed += len(committed)
+	}
+	if ferr != nil {
+		return flushed, ferr
+	}
+
+	done := append(ekeys, dkeys...)
+	done = append(done, slotLenKey(slot))
+	for _, k := range keys {
+		done = append(done, seenKey(slot, k.Name()))
+	}
+	memcache.DeleteMulti(ctx, done)
+	return flushed, nil
+}
+
+// slotBatch makes a batch of the deltas read for a slot's counters.  dkeys
+// are the counters' delta keys, and counters with no delta are left out.
+func slotBatch(keys []CounterKey, dkeys []string,
+	deltas map[string]*memcache.Item) *CounterBatch {
+
+	b := &CounterBatch{}
+	for i, k := range keys {
+		item, ok := deltas[dkeys[i]]
+		if !ok {
+			continue
+		}
+		by, err := strconv.ParseInt(string(item.Value), 10, 64)
+		if err != nil || by == 0 {
+			continue
+		}
+		b.Add(k, by)
+	}
+	return b
+}
+
+// flushSlots returns the first and last slots to flush at now: those that
+// ended more than flushLag ago, back to flushWindow
+func flushSlots(now time.Time) (int64, int64) {
+	return deltaSlotID(now.Add(-flushWindow)),
+		deltaSlotID(now.Add(-flushLag)) - 1
+}
+
+// flushCounters is called by cron.  It flushes the slots that ended more
+// than flushLag ago.  A slot that fails doesn't stop the later ones.
+func flushCounters(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	log.Debugf(ctx, "flushCounters called")
+
+	if !isCronRequest(ctx, r) {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	first, last := flushSlots(time.Now().UTC())
+	flushed := 0
+	var ferr error
+	for slot := first; slot <= last; slot++ {
+		n, err := flushSlot(ctx, slot)
+		if err != nil {
+			log.Errorf(ctx, "Unable to flush counters for slot %d: %s", slot,
+				err.Error())
+			ferr = err
+		}
+		flushed += n
+	}
+	log.Infof(ctx, "Flushed %d counters", flushed)
+	if ferr != nil {
+		http.Error(w, ferr.Error(), http.StatusInternalServerError)
+	}
+}